@@ -3,8 +3,9 @@ module jpeg-recompress.go
 go 1.24.4
 
 require (
-	github.com/gen2brain/jpegli v0.3.4 // indirect
-	github.com/jasonmoo/go-butteraugli v0.0.0-20160529163840-0fc85aed6300 // indirect
-	github.com/tetratelabs/wazero v1.9.0 // indirect
-	golang.org/x/image v0.36.0 // indirect
+	github.com/gen2brain/jpegli v0.3.4
+	github.com/jasonmoo/go-butteraugli v0.0.0-20160529163840-0fc85aed6300
+	golang.org/x/image v0.36.0
 )
+
+require github.com/tetratelabs/wazero v1.9.0 // indirect
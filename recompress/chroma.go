@@ -0,0 +1,93 @@
+package recompress
+
+import (
+	"image"
+	"image/color"
+)
+
+// chromaEdge is the chroma difference between neighbouring pixels above
+// which subsampling visibly smears an edge (coloured text, line art).
+const chromaEdge = 16
+
+// maxChromaEdges is the share of neighbouring pixel pairs across a chroma
+// edge above which a direction keeps its full chroma resolution.
+const maxChromaEdges = 0.01
+
+// chromaEdges returns the share of horizontal and vertical pairs of
+// neighbouring pixels of img separated by a chroma edge, examining one
+// row and column out of sample.
+func chromaEdges(img image.Image, sample int) (float64, float64) {
+	b := img.Bounds()
+	sample = max(sample, 1)
+	chroma := func(x, y int) (int, int) {
+		switch m := img.(type) {
+		case *image.YCbCr:
+			i := m.COffset(x, y)
+			return int(m.Cb[i]), int(m.Cr[i])
+		case *image.RGBA:
+			p := m.Pix[m.PixOffset(x, y):]
+			_, cb, cr := color.RGBToYCbCr(p[0], p[1], p[2])
+			return int(cb), int(cr)
+		}
+		r, g, bl, _ := img.At(x, y).RGBA()
+		_, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(bl>>8))
+		return int(cb), int(cr)
+	}
+	edge := func(x0, y0, x1, y1 int) bool {
+		cb0, cr0 := chroma(x0, y0)
+		cb1, cr1 := chroma(x1, y1)
+		return max(cb0-cb1, cb1-cb0, cr0-cr1, cr1-cr0) > chromaEdge
+	}
+
+	// Subsampling averages the pairs starting on even coordinates
+	var hEdges, hPairs, vEdges, vPairs int
+	for y := b.Min.Y; y < b.Max.Y; y += sample {
+		for x := b.Min.X; x+1 < b.Max.X; x += 2 {
+			hPairs++
+			if edge(x, y, x+1, y) {
+				hEdges++
+			}
+		}
+	}
+	for x := b.Min.X; x < b.Max.X; x += sample {
+		for y := b.Min.Y; y+1 < b.Max.Y; y += 2 {
+			vPairs++
+			if edge(x, y, x, y+1) {
+				vEdges++
+			}
+		}
+	}
+	share := func(n, total int) float64 {
+		if total == 0 {
+			return 0
+		}
+		return float64(n) / float64(total)
+	}
+	return share(hEdges, hPairs), share(vEdges, vPairs)
+}
+
+// autoSubsampling picks the chroma subsampling of img: 4:2:0 unless halving
+// the chroma resolution would blur chroma edges (screenshots, coloured
+// text, line art), 4:2:2 when only the vertical resolution must be kept,
+// 4:4:4 otherwise.
+func autoSubsampling(img image.Image, sample int) image.YCbCrSubsampleRatio {
+	h, v := chromaEdges(img, sample)
+	switch {
+	case h <= maxChromaEdges && v <= maxChromaEdges:
+		return image.YCbCrSubsampleRatio420
+	case h <= maxChromaEdges:
+		return image.YCbCrSubsampleRatio422
+	}
+	return image.YCbCrSubsampleRatio444
+}
+
+// subsamplingName is the inverse of subsampleRatio.
+func subsamplingName(ratio image.YCbCrSubsampleRatio) string {
+	switch ratio {
+	case image.YCbCrSubsampleRatio422:
+		return "422"
+	case image.YCbCrSubsampleRatio420:
+		return "420"
+	}
+	return "444"
+}
@@ -0,0 +1,156 @@
+package recompress
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gen2brain/jpegli"
+)
+
+// EncodeOptions are the settings passed to an Encoder besides quality.
+// Encoders ignore the options they do not support (see EncoderCaps).
+type EncodeOptions struct {
+	ChromaSubsampling image.YCbCrSubsampleRatio
+	Progressive       bool
+}
+
+// EncoderCaps tells which EncodeOptions an Encoder honours.
+type EncoderCaps struct {
+	ChromaSubsampling bool
+	Progressive       bool
+	// DefaultChromaSubsampling is used when Options.ChromaSubsampling is
+	// empty.
+	DefaultChromaSubsampling image.YCbCrSubsampleRatio
+}
+
+// Encoder is a JPEG encoding backend.
+type Encoder interface {
+	// Name is the identifier used by Options.Encoder, in lower case.
+	Name() string
+	// Encode writes img to w as a JPEG at quality (1-100).
+	Encode(w io.Writer, img image.Image, quality int, opts EncodeOptions) error
+	Capabilities() EncoderCaps
+}
+
+var (
+	encodersMu sync.RWMutex
+	encoders   = map[string]Encoder{}
+)
+
+func init() {
+	RegisterEncoder(stdEncoder{})
+	RegisterEncoder(jpegliEncoder{})
+}
+
+// RegisterEncoder makes e available by name. It panics if an encoder with
+// the same name is already registered.
+func RegisterEncoder(e Encoder) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+	name := strings.ToLower(e.Name())
+	if _, dup := encoders[name]; dup {
+		panic("recompress: encoder " + name + " registered twice")
+	}
+	encoders[name] = e
+}
+
+// LookupEncoder returns the registered encoder called name (case-insensitive).
+func LookupEncoder(name string) (Encoder, error) {
+	encodersMu.RLock()
+	defer encodersMu.RUnlock()
+	if e, ok := encoders[strings.ToLower(name)]; ok {
+		return e, nil
+	}
+	return nil, fmt.Errorf("unknown encoder '%s' (use %s)", name, strings.Join(encoderNamesLocked(), ", "))
+}
+
+// EncoderNames returns the names of the registered encoders, sorted.
+func EncoderNames() []string {
+	encodersMu.RLock()
+	defer encodersMu.RUnlock()
+	return encoderNamesLocked()
+}
+
+func encoderNamesLocked() []string {
+	names := make([]string, 0, len(encoders))
+	for name := range encoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// stdEncoder is the Go standard library encoder, which only writes 4:2:0
+// baseline JPEGs. Other subsamplings are encoded with the same
+// quantization and Huffman tables by encodeYCbCr; progressive output is
+// transcoded from the baseline one, coefficients unchanged.
+type stdEncoder struct{}
+
+func (stdEncoder) Name() string { return "std" }
+func (stdEncoder) Capabilities() EncoderCaps {
+	return EncoderCaps{ChromaSubsampling: true, Progressive: true, DefaultChromaSubsampling: image.YCbCrSubsampleRatio420}
+}
+func (stdEncoder) Encode(w io.Writer, img image.Image, quality int, opts EncodeOptions) error {
+	var data []byte
+	if _, gray := img.(*image.Gray); gray || opts.ChromaSubsampling == image.YCbCrSubsampleRatio420 {
+		if !opts.Progressive {
+			return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return err
+		}
+		var err error
+		if data, err = progressiveJPEG(buf.Bytes()); err != nil {
+			return err
+		}
+	} else {
+		if b := img.Bounds(); b.Dx() >= 1<<16 || b.Dy() >= 1<<16 {
+			return errors.New("jpeg: image is too large to encode")
+		}
+		coefs := encodeYCbCr(img, quality, opts.ChromaSubsampling)
+		if opts.Progressive {
+			data = coefs.encodeProgressive()
+		} else {
+			data = coefs.writeBaseline(stdDCTables, stdACTables)
+		}
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// jpegliEncoder is Google's Jpegli, run through WebAssembly.
+type jpegliEncoder struct{}
+
+func (jpegliEncoder) Name() string { return "jpegli" }
+func (jpegliEncoder) Capabilities() EncoderCaps {
+	return EncoderCaps{ChromaSubsampling: true, Progressive: true}
+}
+func (jpegliEncoder) Encode(w io.Writer, img image.Image, quality int, opts EncodeOptions) error {
+	switch img.(type) {
+	case *image.Gray, *image.RGBA, *image.NRGBA, *image.CMYK:
+	default:
+		// The wrapper only subsamples the chroma of the RGB images it is
+		// given: other images would always be encoded as 4:4:4
+		rgba := image.NewRGBA(img.Bounds())
+		draw.Draw(rgba, rgba.Rect, img, rgba.Rect.Min, draw.Src)
+		img = rgba
+	}
+	level := 0
+	if opts.Progressive {
+		level = 2 // The default scan script of cjpegli
+	}
+	return jpegli.Encode(w, img, &jpegli.EncodingOptions{
+		Quality:           quality,
+		ChromaSubsampling: opts.ChromaSubsampling,
+		ProgressiveLevel:  level,
+	})
+}
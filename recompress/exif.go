@@ -0,0 +1,331 @@
+package recompress
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const exifPrefix = "Exif\x00\x00"
+
+// TIFF tags with a special meaning for the parser and writer.
+const (
+	tagStripOffsets     = 0x0111
+	tagThumbnailOffset  = 0x0201
+	tagThumbnailLength  = 0x0202
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagInteropIFD       = 0xA005
+	tagMakerNote        = 0x927C
+	tagCameraOwnerName  = 0xA430
+	tagBodySerialNumber = 0xA431
+	tagLensSerialNumber = 0xA435
+	tagCameraSerialDNG  = 0xC62F
+)
+
+// subIFDTags are the pointers to child IFDs that are parsed and rewritten.
+var subIFDTags = map[uint16]bool{tagExifIFD: true, tagGPSIFD: true, tagInteropIFD: true}
+
+// privateTags are removed by scrubExif, with the name used in reports. The
+// MakerNote is a vendor blob that holds serial numbers and whose internal
+// offsets do not survive a rewrite.
+var privateTags = map[uint16]string{
+	tagGPSIFD:           "GPS",
+	tagMakerNote:        "MakerNote",
+	tagCameraOwnerName:  "CameraOwnerName",
+	tagBodySerialNumber: "BodySerialNumber",
+	tagLensSerialNumber: "LensSerialNumber",
+	tagCameraSerialDNG:  "CameraSerialNumber",
+}
+
+// tiffTypeSizes is the size in bytes of one value of each TIFF type.
+var tiffTypeSizes = [...]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4}
+
+// tiffEntry is one IFD entry. Value holds the raw bytes of the values, in
+// the byte order of the file, wherever they were stored. Entries of an
+// unknown type are Opaque: the size of their values cannot be known, so
+// Value holds the 4 bytes of the value field, written back unchanged.
+type tiffEntry struct {
+	Tag    uint16
+	Type   uint16
+	Count  uint32
+	Value  []byte
+	Opaque bool
+}
+
+// tiffIFD is an IFD with its child IFDs (keyed by pointer tag), the next
+// IFD of the chain and, for IFD1, the JPEG thumbnail it points to.
+type tiffIFD struct {
+	Entries   []tiffEntry
+	Sub       map[uint16]*tiffIFD
+	Next      *tiffIFD
+	Thumbnail []byte
+}
+
+// tiffFile is a parsed TIFF structure, as found in an Exif APP1 segment.
+type tiffFile struct {
+	Order binary.ByteOrder
+	IFD0  *tiffIFD
+}
+
+// parseTIFF parses the TIFF header and the IFD tree of data. Broken child
+// IFDs and thumbnails are dropped rather than failing the whole parse.
+func parseTIFF(data []byte) (*tiffFile, error) {
+	if len(data) < 8 {
+		return nil, errors.New("tiff: header too short")
+	}
+	t := &tiffFile{}
+	switch string(data[:2]) {
+	case "II":
+		t.Order = binary.LittleEndian
+	case "MM":
+		t.Order = binary.BigEndian
+	default:
+		return nil, errors.New("tiff: invalid byte order")
+	}
+	if t.Order.Uint16(data[2:]) != 42 {
+		return nil, errors.New("tiff: invalid magic number")
+	}
+	p := &tiffParser{data: data, order: t.Order, seen: map[uint32]bool{}}
+	ifd0, err := p.parseIFD(t.Order.Uint32(data[4:]), true)
+	if err != nil {
+		return nil, err
+	}
+	t.IFD0 = ifd0
+	return t, nil
+}
+
+type tiffParser struct {
+	data  []byte
+	order binary.ByteOrder
+	seen  map[uint32]bool // Guards against IFD loops
+}
+
+func (p *tiffParser) parseIFD(offset uint32, chain bool) (*tiffIFD, error) {
+	if p.seen[offset] {
+		return nil, fmt.Errorf("tiff: IFD loop at offset %d", offset)
+	}
+	p.seen[offset] = true
+	if uint64(offset)+2 > uint64(len(p.data)) {
+		return nil, fmt.Errorf("tiff: IFD offset %d out of range", offset)
+	}
+	n := int(p.order.Uint16(p.data[offset:]))
+	start := int(offset) + 2
+	if start+12*n+4 > len(p.data) {
+		return nil, fmt.Errorf("tiff: IFD at offset %d truncated", offset)
+	}
+	ifd := &tiffIFD{Sub: map[uint16]*tiffIFD{}}
+	for i := 0; i < n; i++ {
+		e := p.data[start+12*i:]
+		entry := tiffEntry{Tag: p.order.Uint16(e), Type: p.order.Uint16(e[2:]), Count: p.order.Uint32(e[4:])}
+		if int(entry.Type) >= len(tiffTypeSizes) || tiffTypeSizes[entry.Type] == 0 {
+			entry.Value, entry.Opaque = append([]byte(nil), e[8:12]...), true
+			ifd.Entries = append(ifd.Entries, entry)
+			continue
+		}
+		size := uint64(entry.Count) * uint64(tiffTypeSizes[entry.Type])
+		if size <= 4 {
+			entry.Value = append([]byte(nil), e[8:8+size]...)
+		} else {
+			at := uint64(p.order.Uint32(e[8:]))
+			if at+size > uint64(len(p.data)) {
+				continue
+			}
+			entry.Value = append([]byte(nil), p.data[at:at+size]...)
+		}
+		if subIFDTags[entry.Tag] {
+			if entry.Count != 1 || size != 4 {
+				continue
+			}
+			sub, err := p.parseIFD(p.order.Uint32(entry.Value), false)
+			if err != nil {
+				continue
+			}
+			ifd.Sub[entry.Tag] = sub
+		}
+		ifd.Entries = append(ifd.Entries, entry)
+	}
+	if off, ok := ifd.uint(tagThumbnailOffset, p.order); ok {
+		length, _ := ifd.uint(tagThumbnailLength, p.order)
+		if uint64(off)+uint64(length) <= uint64(len(p.data)) {
+			ifd.Thumbnail = p.data[off : off+length]
+		} else {
+			ifd.remove(tagThumbnailOffset)
+			ifd.remove(tagThumbnailLength)
+		}
+	}
+	if chain {
+		if next := p.order.Uint32(p.data[start+12*n:]); next != 0 {
+			// Strips of uncompressed thumbnails cannot be relocated: such
+			// an IFD is dropped.
+			if ifd1, err := p.parseIFD(next, true); err == nil && ifd1.find(tagStripOffsets) < 0 {
+				ifd.Next = ifd1
+			}
+		}
+	}
+	return ifd, nil
+}
+
+// find returns the index of the entry with tag, or -1.
+func (ifd *tiffIFD) find(tag uint16) int {
+	for i, e := range ifd.Entries {
+		if e.Tag == tag {
+			return i
+		}
+	}
+	return -1
+}
+
+// remove deletes the entry with tag, and the child IFD it points to. It
+// reports whether the entry existed.
+func (ifd *tiffIFD) remove(tag uint16) bool {
+	i := ifd.find(tag)
+	if i < 0 {
+		return false
+	}
+	ifd.Entries = append(ifd.Entries[:i], ifd.Entries[i+1:]...)
+	delete(ifd.Sub, tag)
+	return true
+}
+
+// uint returns the first value of a SHORT or LONG entry.
+func (ifd *tiffIFD) uint(tag uint16, order binary.ByteOrder) (uint32, bool) {
+	i := ifd.find(tag)
+	if i < 0 || ifd.Entries[i].Count < 1 {
+		return 0, false
+	}
+	e := ifd.Entries[i]
+	switch e.Type {
+	case 3:
+		return uint32(order.Uint16(e.Value)), true
+	case 4, 13:
+		return order.Uint32(e.Value), true
+	}
+	return 0, false
+}
+
+// bytes serializes t. Every IFD is followed by the values that do not fit
+// in its entries, then by its child IFDs; pointers are recomputed.
+func (t *tiffFile) bytes() []byte {
+	var buf bytes.Buffer
+	if t.Order == binary.ByteOrder(binary.LittleEndian) {
+		buf.WriteString("II")
+	} else {
+		buf.WriteString("MM")
+	}
+	var hdr [6]byte
+	t.Order.PutUint16(hdr[:], 42)
+	t.Order.PutUint32(hdr[2:], 8)
+	buf.Write(hdr[:])
+	w := &tiffWriter{buf: &buf, order: t.Order}
+	w.writeIFD(t.IFD0)
+	return buf.Bytes()
+}
+
+type tiffWriter struct {
+	buf   *bytes.Buffer
+	order binary.ByteOrder
+}
+
+// patch overwrites the 4 bytes at offset with v.
+func (w *tiffWriter) patch(offset int, v uint32) {
+	w.order.PutUint32(w.buf.Bytes()[offset:], v)
+}
+
+// pad keeps values on word boundaries, as TIFF requires.
+func (w *tiffWriter) pad() {
+	if w.buf.Len()%2 != 0 {
+		w.buf.WriteByte(0)
+	}
+}
+
+// writeIFD writes ifd at the end of the buffer and returns its offset.
+func (w *tiffWriter) writeIFD(ifd *tiffIFD) uint32 {
+	w.pad()
+	start := w.buf.Len()
+	var b [12]byte
+	w.order.PutUint16(b[:], uint16(len(ifd.Entries)))
+	w.buf.Write(b[:2])
+	valueAt := make([]int, len(ifd.Entries)) // Offsets of the value fields
+	for i, e := range ifd.Entries {
+		w.order.PutUint16(b[:], e.Tag)
+		w.order.PutUint16(b[2:], e.Type)
+		w.order.PutUint32(b[4:], e.Count)
+		clear(b[8:])
+		if len(e.Value) <= 4 || e.Opaque {
+			copy(b[8:], e.Value)
+		}
+		valueAt[i] = w.buf.Len() + 8
+		w.buf.Write(b[:])
+	}
+	nextAt := w.buf.Len()
+	w.buf.Write([]byte{0, 0, 0, 0})
+
+	for i, e := range ifd.Entries {
+		if len(e.Value) > 4 && !e.Opaque {
+			w.pad()
+			w.patch(valueAt[i], uint32(w.buf.Len()))
+			w.buf.Write(e.Value)
+		}
+	}
+	for i, e := range ifd.Entries {
+		if sub, ok := ifd.Sub[e.Tag]; ok {
+			w.patch(valueAt[i], w.writeIFD(sub))
+		}
+	}
+	if i := ifd.find(tagThumbnailOffset); i >= 0 && ifd.Thumbnail != nil {
+		w.patch(valueAt[i], uint32(w.buf.Len()))
+		w.buf.Write(ifd.Thumbnail)
+	}
+	if ifd.Next != nil {
+		w.patch(nextAt, w.writeIFD(ifd.Next))
+	}
+	return uint32(start)
+}
+
+// scrubExif removes location and device identifiers (see privateTags) from
+// the Exif APP1 segment seg and returns the rewritten segment with the
+// names of the removed fields. Everything else, orientation included, is
+// preserved.
+func scrubExif(seg []byte) ([]byte, []string, error) {
+	t, err := parseTIFF(seg[4+len(exifPrefix):])
+	if err != nil {
+		return nil, nil, err
+	}
+	var removed []string
+	for ifd := t.IFD0; ifd != nil; ifd = ifd.Next {
+		removed = append(removed, scrubIFD(ifd)...)
+	}
+	if len(removed) == 0 {
+		return seg, nil, nil
+	}
+	out, err := exifSegment(t)
+	return out, removed, err
+}
+
+// scrubIFD removes the private tags of ifd and of its child IFDs.
+func scrubIFD(ifd *tiffIFD) []string {
+	var removed []string
+	for _, e := range append([]tiffEntry(nil), ifd.Entries...) {
+		if name, ok := privateTags[e.Tag]; ok && ifd.remove(e.Tag) {
+			removed = append(removed, name)
+		}
+	}
+	for _, e := range ifd.Entries {
+		if sub, ok := ifd.Sub[e.Tag]; ok {
+			removed = append(removed, scrubIFD(sub)...)
+		}
+	}
+	return removed
+}
+
+// exifSegment returns the APP1 segment holding t.
+func exifSegment(t *tiffFile) ([]byte, error) {
+	payload := append([]byte(exifPrefix), t.bytes()...)
+	if len(payload)+2 > 0xFFFF {
+		return nil, errors.New("exif: rewritten segment too large")
+	}
+	seg := []byte{0xFF, 0xE1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}
+	return append(seg, payload...), nil
+}
@@ -0,0 +1,186 @@
+package recompress
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// fixtureEntry is an IFD entry of a test Exif block. Pointer entries get
+// their value when the block is laid out.
+type fixtureEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+}
+
+// testJPEG encodes a w x h gradient with image/jpeg at quality.
+func testJPEG(t *testing.T, w, h, quality int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * 255 / w), uint8(y * 255 / h), uint8((x ^ y) * 7), 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testExif returns an Exif APP1 segment of byte order o, laid out as
+// cameras write it: IFD0 (Make, Orientation 6, pointers to the Exif and GPS IFDs),
+// the Exif IFD (exposure time, body serial number), the GPS IFD (latitude,
+// map datum set to datum) and IFD1 with thumb as JPEG thumbnail.
+func testExif(o binary.AppendByteOrder, datum string, thumb []byte) []byte {
+	short := func(v uint16) []byte { return o.AppendUint16(nil, v) }
+	long := func(v uint32) []byte { return o.AppendUint32(nil, v) }
+	ascii := func(s string) []byte { return append([]byte(s), 0) }
+	rationals := func(v ...uint32) []byte {
+		var b []byte
+		for _, x := range v {
+			b = o.AppendUint32(b, x)
+		}
+		return b
+	}
+	ifd0 := []fixtureEntry{
+		{0x010F, 2, 8, ascii("TestCam")},
+		{0x0112, 3, 1, short(6)},
+		{tagExifIFD, 4, 1, nil},
+		{tagGPSIFD, 4, 1, nil},
+	}
+	exif := []fixtureEntry{
+		{0x829A, 5, 1, rationals(1, 100)},
+		{tagBodySerialNumber, 2, 9, ascii("SN-12345")},
+	}
+	gps := []fixtureEntry{
+		{0x0001, 2, 2, ascii("N")},
+		{0x0002, 5, 3, rationals(48, 1, 51, 1, 2400, 100)},
+		{0x0012, 2, uint32(len(datum) + 1), ascii(datum)},
+	}
+	ifd1 := []fixtureEntry{
+		{0x0103, 3, 1, short(6)},
+		{tagThumbnailOffset, 4, 1, nil},
+		{tagThumbnailLength, 4, 1, long(uint32(len(thumb)))},
+	}
+	size := func(entries []fixtureEntry) int {
+		n := 2 + 12*len(entries) + 4
+		for _, e := range entries {
+			if len(e.value) > 4 {
+				n += (len(e.value) + 1) &^ 1
+			}
+		}
+		return n
+	}
+	at0 := 8
+	atExif := at0 + size(ifd0)
+	atGPS := atExif + size(exif)
+	at1 := atGPS + size(gps)
+	atThumb := at1 + size(ifd1)
+	ifd0[2].value, ifd0[3].value, ifd1[1].value = long(uint32(atExif)), long(uint32(atGPS)), long(uint32(atThumb))
+
+	tiff := []byte("MM")
+	if o == binary.LittleEndian {
+		tiff = []byte("II")
+	}
+	tiff = o.AppendUint32(o.AppendUint16(tiff, 42), 8)
+	write := func(entries []fixtureEntry, next int) {
+		start := len(tiff)
+		tiff = o.AppendUint16(tiff, uint16(len(entries)))
+		extra := start + 2 + 12*len(entries) + 4
+		var values []byte
+		for _, e := range entries {
+			tiff = o.AppendUint16(tiff, e.tag)
+			tiff = o.AppendUint16(tiff, e.typ)
+			tiff = o.AppendUint32(tiff, e.count)
+			if len(e.value) <= 4 {
+				tiff = append(tiff, append(e.value, make([]byte, 4-len(e.value))...)...)
+				continue
+			}
+			tiff = o.AppendUint32(tiff, uint32(extra+len(values)))
+			values = append(values, e.value...)
+			if len(values)%2 != 0 {
+				values = append(values, 0)
+			}
+		}
+		tiff = o.AppendUint32(tiff, uint32(next))
+		tiff = append(tiff, values...)
+	}
+	write(ifd0, at1)
+	write(exif, 0)
+	write(gps, 0)
+	write(ifd1, 0)
+	tiff = append(tiff, thumb...)
+
+	payload := append([]byte(exifPrefix), tiff...)
+	return append([]byte{0xFF, 0xE1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}, payload...)
+}
+
+// withSegment inserts seg right after the SOI of the JPEG data.
+func withSegment(data, seg []byte) []byte {
+	return append(append(append([]byte(nil), data[:2]...), seg...), data[2:]...)
+}
+
+// TestScrubExif checks that scrubbing an Exif segment removes the GPS IFD
+// and the body serial number, and that the rewritten segment parses back
+// with the other tags and the thumbnail intact, in both byte orders.
+func TestScrubExif(t *testing.T) {
+	thumb := testJPEG(t, 16, 12, 80)
+	for _, order := range []binary.AppendByteOrder{binary.BigEndian, binary.LittleEndian} {
+		seg := testExif(order, "WGS-84", thumb)
+		out, removed, err := scrubExif(seg)
+		if err != nil {
+			t.Fatalf("%v: %v", order, err)
+		}
+		if len(removed) != 2 || removed[0] != "GPS" || removed[1] != "BodySerialNumber" {
+			t.Errorf("%v: removed %v, want [GPS BodySerialNumber]", order, removed)
+		}
+		if n := int(out[2])<<8 | int(out[3]); n != len(out)-2 {
+			t.Errorf("%v: segment length %d, want %d", order, n, len(out)-2)
+		}
+		for _, private := range []string{"WGS-84", "SN-12345"} {
+			if bytes.Contains(out, []byte(private)) {
+				t.Errorf("%v: %s is still in the segment", order, private)
+			}
+		}
+
+		tf, err := parseTIFF(out[4+len(exifPrefix):])
+		if err != nil {
+			t.Fatalf("%v: rewritten segment: %v", order, err)
+		}
+		ifd0 := tf.IFD0
+		if i := ifd0.find(0x010F); i < 0 || string(ifd0.Entries[i].Value) != "TestCam\x00" {
+			t.Errorf("%v: Make lost", order)
+		}
+		if v, ok := ifd0.uint(0x0112, tf.Order); !ok || v != 6 {
+			t.Errorf("%v: orientation %d, want 6", order, v)
+		}
+		if ifd0.find(tagGPSIFD) >= 0 || ifd0.Sub[tagGPSIFD] != nil {
+			t.Errorf("%v: GPS IFD kept", order)
+		}
+		exif := ifd0.Sub[tagExifIFD]
+		if exif == nil {
+			t.Fatalf("%v: Exif IFD lost", order)
+		}
+		if i := exif.find(0x829A); i < 0 || tf.Order.Uint32(exif.Entries[i].Value) != 1 || tf.Order.Uint32(exif.Entries[i].Value[4:]) != 100 {
+			t.Errorf("%v: exposure time lost", order)
+		}
+		if exif.find(tagBodySerialNumber) >= 0 {
+			t.Errorf("%v: body serial number kept", order)
+		}
+		if ifd0.Next == nil || !bytes.Equal(ifd0.Next.Thumbnail, thumb) {
+			t.Fatalf("%v: thumbnail lost", order)
+		}
+		if v, ok := ifd0.Next.uint(tagThumbnailLength, tf.Order); !ok || int(v) != len(thumb) {
+			t.Errorf("%v: thumbnail length %d, want %d", order, v, len(thumb))
+		}
+		if _, err := jpeg.DecodeConfig(bytes.NewReader(ifd0.Next.Thumbnail)); err != nil {
+			t.Errorf("%v: thumbnail: %v", order, err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package recompress
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RecompressFile recompresses src into dst, or in place when dst is empty.
+// The new file is first written next to src and then moved over the
+// destination, which keeps the permissions and modification time of src.
+// When there is nothing to gain, an in-place run leaves src untouched
+// (Skipped) while a separate destination receives a copy of it (Copied).
+func RecompressFile(ctx context.Context, src, dst string, opts Options) (Result, error) {
+	startTime := time.Now()
+	res := Result{}
+	absSrc, _ := filepath.Abs(src)
+	srcInfo, err := os.Stat(absSrc)
+	if err != nil {
+		res.Err = err
+		return res, err
+	}
+	res.SizeBefore = srcInfo.Size()
+	res.SourceInfo = srcInfo
+	originalModTime := srcInfo.ModTime()
+
+	targetPath := dst
+	if targetPath == "" {
+		targetPath = absSrc
+	} else {
+		targetPath, _ = filepath.Abs(targetPath)
+	}
+
+	in, err := os.Open(absSrc)
+	if err != nil {
+		res.Err = err
+		return res, err
+	}
+	defer in.Close()
+
+	tempPath := absSrc + ".tmp_recompress"
+	tmp, err := os.Create(tempPath)
+	if err != nil {
+		res.Err = fmt.Errorf("error writing temp file: %v", err)
+		return res, res.Err
+	}
+	defer os.Remove(tempPath)
+
+	res, err = Recompress(ctx, in, tmp, opts)
+	res.SourceInfo = srcInfo
+	if cerr := tmp.Close(); cerr != nil && err == nil {
+		err = fmt.Errorf("error writing temp file: %v", cerr)
+		res.Err = err
+	}
+	if err != nil {
+		return res, err
+	}
+
+	if res.Skipped || res.Copied {
+		if targetPath == absSrc {
+			res.Skipped, res.Copied = true, false
+			res.OutputInfo = srcInfo
+		} else {
+			_ = os.MkdirAll(filepath.Dir(targetPath), 0755)
+			if err := copyFile(absSrc, targetPath); err != nil {
+				res.Err = fmt.Errorf("error copying original to destination: %v", err)
+				return res, res.Err
+			}
+			_ = os.Chtimes(targetPath, originalModTime, originalModTime)
+			res.Skipped, res.Copied = false, true
+			res.OutputInfo, _ = os.Stat(targetPath)
+		}
+		res.Duration = time.Since(startTime)
+		return res, nil
+	}
+
+	// Prepare destination directory if needed
+	if dst != "" {
+		if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+			res.Err = fmt.Errorf("error creating directory: %v", err)
+			return res, res.Err
+		}
+	}
+
+	// Critical section: atomic-like move or copy
+	// os.Rename is atomic on most systems, so the source is replaced in one step.
+	if err := moveFile(tempPath, targetPath); err != nil {
+		if targetPath == absSrc {
+			res.Err = fmt.Errorf("error overwriting source file: %v", err)
+		} else {
+			res.Err = fmt.Errorf("error moving to destination: %v", err)
+		}
+		return res, res.Err
+	}
+
+	_ = os.Chtimes(targetPath, originalModTime, originalModTime)
+	_ = os.Chmod(targetPath, srcInfo.Mode())
+
+	finalInfo, _ := os.Stat(targetPath)
+	res.OutputInfo = finalInfo
+	res.SizeAfter = finalInfo.Size()
+	res.Duration = time.Since(startTime)
+	return res, nil
+}
+
+func copyFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	if _, err = io.Copy(out, in); err != nil {
+		return err
+	}
+
+	srcInfo, _ := os.Stat(src)
+	return os.Chmod(dst, srcInfo.Mode())
+}
+
+func moveFile(src, dst string) error {
+	// Try atomic rename first
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+
+	// Fallback for cross-device: copy then remove
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,303 @@
+package recompress
+
+import (
+	"bytes"
+	"math/bits"
+)
+
+// huffTable is a Huffman table as stored in a DHT segment, with the codes
+// derived from it.
+type huffTable struct {
+	counts [16]byte // Number of codes of each length, 1 to 16 bits
+	vals   []byte   // Symbols, by increasing code length
+	code   [256]uint16
+	size   [256]byte
+}
+
+// optimalHuffTable builds the optimal table for the symbol frequencies
+// freq, with codes of at most 16 bits and no all-ones code (JPEG Annex
+// K.2, as libjpeg does).
+func optimalHuffTable(freq *[256]int64) *huffTable {
+	var f [257]int64
+	copy(f[:], freq[:])
+	f[256] = 1 // Reserved symbol: no real code is all ones
+	var codesize [257]int
+	var others [257]int
+	for i := range others {
+		others[i] = -1
+	}
+	for {
+		// c1 and c2 are the least frequent symbols, the larger value
+		// first on ties
+		c1, c2 := -1, -1
+		for i := 0; i <= 256; i++ {
+			if f[i] > 0 && (c1 < 0 || f[i] <= f[c1]) {
+				c1 = i
+			}
+		}
+		for i := 0; i <= 256; i++ {
+			if f[i] > 0 && i != c1 && (c2 < 0 || f[i] <= f[c2]) {
+				c2 = i
+			}
+		}
+		if c2 < 0 {
+			break
+		}
+		f[c1] += f[c2]
+		f[c2] = 0
+		codesize[c1]++
+		for others[c1] >= 0 {
+			c1 = others[c1]
+			codesize[c1]++
+		}
+		others[c1] = c2
+		codesize[c2]++
+		for others[c2] >= 0 {
+			c2 = others[c2]
+			codesize[c2]++
+		}
+	}
+
+	var count [33]int
+	for _, s := range codesize {
+		if s > 0 {
+			count[min(s, 32)]++
+		}
+	}
+	// Limit the code lengths to 16 bits
+	for i := 32; i > 16; i-- {
+		for count[i] > 0 {
+			j := i - 2
+			for count[j] == 0 {
+				j--
+			}
+			count[i] -= 2
+			count[i-1]++
+			count[j+1] += 2
+			count[j]--
+		}
+	}
+	// Remove the reserved symbol, which has the longest code
+	i := 16
+	for count[i] == 0 {
+		i--
+	}
+	count[i]--
+
+	t := &huffTable{}
+	for l := 1; l <= 16; l++ {
+		t.counts[l-1] = byte(count[l])
+	}
+	for l := 1; l <= 32; l++ {
+		for s := 0; s < 256; s++ {
+			if codesize[s] == l {
+				t.vals = append(t.vals, byte(s))
+			}
+		}
+	}
+	t.assignCodes()
+	return t
+}
+
+// assignCodes derives the canonical codes of the table (Annex C).
+func (t *huffTable) assignCodes() {
+	code, k := uint16(0), 0
+	for l := 1; l <= 16; l++ {
+		for n := 0; n < int(t.counts[l-1]); n++ {
+			t.code[t.vals[k]], t.size[t.vals[k]] = code, byte(l)
+			code++
+			k++
+		}
+		code <<= 1
+	}
+}
+
+// bitWriter writes entropy-coded data, stuffing a zero after 0xFF bytes.
+type bitWriter struct {
+	buf *bytes.Buffer
+	acc uint32
+	n   uint
+}
+
+func (w *bitWriter) write(v uint32, n uint) {
+	w.acc = w.acc<<n | v&(1<<n-1)
+	w.n += n
+	for w.n >= 8 {
+		b := byte(w.acc >> (w.n - 8))
+		w.buf.WriteByte(b)
+		if b == 0xFF {
+			w.buf.WriteByte(0)
+		}
+		w.n -= 8
+	}
+}
+
+// flush pads the last byte with ones.
+func (w *bitWriter) flush() {
+	if w.n > 0 {
+		w.write(1<<(8-w.n)-1, 8-w.n)
+	}
+}
+
+// magnitude returns the size category of v and the bits that encode it
+// (F.1.2.1).
+func magnitude(v int32) (uint, uint32) {
+	a := v
+	if a < 0 {
+		a = -a
+		v--
+	}
+	s := uint(bits.Len32(uint32(a)))
+	return s, uint32(v) & (1<<s - 1)
+}
+
+// blockSymbols calls dc and ac with the Huffman symbol and the extra bits of
+// every code of a sequential block: the DC difference with the previous DC
+// value pred, then the run-length coded AC coefficients.
+func blockSymbols(blk []int16, pred int32, dc func(sym byte, v uint32, n uint), ac func(sym byte, v uint32, n uint)) {
+	s, v := magnitude(int32(blk[0]) - pred)
+	dc(byte(s), v, s)
+	run := 0
+	for k := 1; k < 64; k++ {
+		if blk[k] == 0 {
+			run++
+			continue
+		}
+		for run > 15 {
+			ac(0xF0, 0, 0) // ZRL
+			run -= 16
+		}
+		s, v := magnitude(int32(blk[k]))
+		ac(byte(run<<4)|byte(s), v, s)
+		run = 0
+	}
+	if run > 0 {
+		ac(0x00, 0, 0) // EOB
+	}
+}
+
+// eachBlock calls fn with the blocks of a scan of the components comps (by
+// index), in coding order: MCU by MCU when the scan is interleaved,
+// otherwise over the component itself.
+func (j *jpegCoefs) eachBlock(comps []int, fn func(i int, blk []int16)) {
+	if len(comps) == 1 {
+		c := j.comps[comps[0]]
+		for by := 0; by < c.ch; by++ {
+			for bx := 0; bx < c.cw; bx++ {
+				fn(comps[0], c.block(bx, by))
+			}
+		}
+		return
+	}
+	for my := 0; my < j.mcusY; my++ {
+		for mx := 0; mx < j.mcusX; mx++ {
+			for _, i := range comps {
+				c := j.comps[i]
+				for y := 0; y < int(c.v); y++ {
+					for x := 0; x < int(c.h); x++ {
+						fn(i, c.block(mx*int(c.h)+x, my*int(c.v)+y))
+					}
+				}
+			}
+		}
+	}
+}
+
+// writeSegment writes a marker segment with its length.
+func writeSegment(out *bytes.Buffer, marker byte, payload []byte) {
+	out.Write([]byte{0xFF, marker, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)})
+	out.Write(payload)
+}
+
+// writeFrame writes SOI, the DQT segments and the SOF segment of marker.
+func (j *jpegCoefs) writeFrame(out *bytes.Buffer, marker byte) {
+	out.Write([]byte{0xFF, 0xD8})
+	for _, seg := range j.dqt {
+		out.Write(seg)
+	}
+	sof := []byte{8, byte(j.height >> 8), byte(j.height), byte(j.width >> 8), byte(j.width), byte(len(j.comps))}
+	for _, c := range j.comps {
+		sof = append(sof, c.id, c.h<<4|c.v, c.tq)
+	}
+	writeSegment(out, marker, sof)
+}
+
+// dhtTable returns the DHT payload of table ht, of class 0 (DC) or 1 (AC)
+// and destination id.
+func dhtTable(class, id int, ht *huffTable) []byte {
+	p := append([]byte{byte(class<<4 | id)}, ht.counts[:]...)
+	return append(p, ht.vals...)
+}
+
+// encodeBaseline writes the coefficients as a baseline (or extended, for
+// 16-bit quantization tables) sequential JPEG with optimal Huffman tables.
+func (j *jpegCoefs) encodeBaseline() []byte {
+	var dcFreq, acFreq [2][256]int64
+	j.sequentialScan(func(t int, blk []int16, pred int32) {
+		blockSymbols(blk, pred,
+			func(sym byte, _ uint32, _ uint) { dcFreq[t][sym]++ },
+			func(sym byte, _ uint32, _ uint) { acFreq[t][sym]++ })
+	})
+	var dc, ac [2]*huffTable
+	for t := 0; t < min(len(j.comps), 2); t++ {
+		dc[t], ac[t] = optimalHuffTable(&dcFreq[t]), optimalHuffTable(&acFreq[t])
+	}
+	return j.writeBaseline(dc, ac)
+}
+
+// sequentialScan calls fn with the Huffman tables, the coefficients and the
+// DC predictor of every block of a single interleaved scan. The first
+// component uses tables 0, the others tables 1.
+func (j *jpegCoefs) sequentialScan(fn func(t int, blk []int16, pred int32)) {
+	comps := make([]int, len(j.comps))
+	for i := range comps {
+		comps[i] = i
+	}
+	preds := make([]int32, len(j.comps))
+	j.eachBlock(comps, func(i int, blk []int16) {
+		fn(min(i, 1), blk, preds[i])
+		preds[i] = int32(blk[0])
+	})
+}
+
+// writeBaseline writes SOI, DQT, SOF, the DHT of the DC and AC tables dc
+// and ac, a single interleaved scan coded with them and EOI.
+func (j *jpegCoefs) writeBaseline(dc, ac [2]*huffTable) []byte {
+	ntables := min(len(j.comps), 2)
+	var out bytes.Buffer
+	sofMarker := byte(0xC0)
+	if j.extended {
+		sofMarker = 0xC1
+	}
+	j.writeFrame(&out, sofMarker)
+
+	var dht []byte
+	for t := 0; t < ntables; t++ {
+		dht = append(dht, dhtTable(0, t, dc[t])...)
+		dht = append(dht, dhtTable(1, t, ac[t])...)
+	}
+	writeSegment(&out, 0xC4, dht)
+
+	sos := []byte{byte(len(j.comps))}
+	for i, c := range j.comps {
+		t := byte(min(i, 1))
+		sos = append(sos, c.id, t<<4|t)
+	}
+	writeSegment(&out, 0xDA, append(sos, 0, 63, 0))
+
+	w := &bitWriter{buf: &out}
+	j.sequentialScan(func(t int, blk []int16, pred int32) {
+		blockSymbols(blk, pred,
+			func(sym byte, v uint32, n uint) {
+				w.write(uint32(dc[t].code[sym]), uint(dc[t].size[sym]))
+				w.write(v, n)
+			},
+			func(sym byte, v uint32, n uint) {
+				w.write(uint32(ac[t].code[sym]), uint(ac[t].size[sym]))
+				w.write(v, n)
+			})
+	})
+	w.flush()
+	out.Write([]byte{0xFF, 0xD9})
+	return out.Bytes()
+}
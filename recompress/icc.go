@@ -0,0 +1,406 @@
+package recompress
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+const iccPrefix = "ICC_PROFILE\x00"
+
+// iccProfile returns the ICC profile of the JPEG data, reassembled from its
+// APP2 chunks, or nil if there is none.
+func iccProfile(data []byte) []byte {
+	type chunk struct {
+		seq  byte
+		data []byte
+	}
+	var chunks []chunk
+	walkSegments(data, func(marker byte, seg []byte) bool {
+		if marker == 0xDA {
+			return false
+		}
+		if segmentIdentifier(seg) == "ICC_PROFILE" && len(seg) >= 4+len(iccPrefix)+2 {
+			chunks = append(chunks, chunk{seg[4+len(iccPrefix)], seg[4+len(iccPrefix)+2:]})
+		}
+		return true
+	})
+	sort.SliceStable(chunks, func(i, j int) bool { return chunks[i].seq < chunks[j].seq })
+	var profile []byte
+	for _, c := range chunks {
+		profile = append(profile, c.data...)
+	}
+	return profile
+}
+
+// iccSegments splits an ICC profile into APP2 segments.
+func iccSegments(profile []byte) [][]byte {
+	const maxChunk = 0xFFFF - 2 - len(iccPrefix) - 2
+	n := (len(profile) + maxChunk - 1) / maxChunk
+	var segs [][]byte
+	for i := 0; i < n; i++ {
+		part := profile[i*maxChunk : min((i+1)*maxChunk, len(profile))]
+		length := 2 + len(iccPrefix) + 2 + len(part)
+		seg := []byte{0xFF, 0xE2, byte(length >> 8), byte(length)}
+		seg = append(seg, iccPrefix...)
+		seg = append(seg, byte(i+1), byte(n))
+		segs = append(segs, append(seg, part...))
+	}
+	return segs
+}
+
+// iccInfo is what is known of an ICC profile.
+type iccInfo struct {
+	Description string
+	ColorSpace  string // RGB, GRAY, CMYK...
+	// Matrix/TRC profiles: the colorants (columns, XYZ D50) and the tone
+	// curves of the red, green and blue channels.
+	Matrix *[3][3]float64
+	TRC    [3]func(float64) float64
+}
+
+// parseICC reads the header and the tags of an ICC profile needed to
+// identify it and, for matrix/TRC RGB profiles, to convert its pixels.
+func parseICC(p []byte) (*iccInfo, error) {
+	if len(p) < 132 || string(p[36:40]) != "acsp" {
+		return nil, errors.New("icc: invalid profile header")
+	}
+	info := &iccInfo{ColorSpace: strings.TrimSpace(string(p[16:20]))}
+	tags := map[string][]byte{}
+	n := int(binary.BigEndian.Uint32(p[128:]))
+	for i := 0; i < n && 132+12*i+12 <= len(p); i++ {
+		e := p[132+12*i:]
+		off, size := binary.BigEndian.Uint32(e[4:]), binary.BigEndian.Uint32(e[8:])
+		if uint64(off)+uint64(size) <= uint64(len(p)) && size >= 8 {
+			tags[string(e[:4])] = p[off : off+size]
+		}
+	}
+	info.Description = iccText(tags["desc"])
+
+	if info.ColorSpace != "RGB" {
+		return info, nil
+	}
+	var m [3][3]float64
+	for c, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		t := tags[sig]
+		if len(t) < 20 || string(t[:4]) != "XYZ " {
+			return info, nil
+		}
+		for k := 0; k < 3; k++ {
+			m[k][c] = s15Fixed16(t[8+4*k:])
+		}
+	}
+	for c, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		if info.TRC[c] = iccCurve(tags[sig]); info.TRC[c] == nil {
+			return info, nil
+		}
+	}
+	info.Matrix = &m
+	return info, nil
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// iccText decodes a desc (ICC v2) or mluc (ICC v4) tag.
+func iccText(t []byte) string {
+	switch {
+	case len(t) >= 12 && string(t[:4]) == "desc":
+		n := int(binary.BigEndian.Uint32(t[8:]))
+		if 12+n <= len(t) {
+			return strings.TrimRight(string(t[12:12+n]), "\x00")
+		}
+	case len(t) >= 28 && string(t[:4]) == "mluc":
+		length, off := binary.BigEndian.Uint32(t[20:]), binary.BigEndian.Uint32(t[24:])
+		if uint64(off)+uint64(length) <= uint64(len(t)) {
+			u := make([]uint16, length/2)
+			for i := range u {
+				u[i] = binary.BigEndian.Uint16(t[int(off)+2*i:])
+			}
+			return strings.TrimRight(string(utf16.Decode(u)), "\x00")
+		}
+	}
+	return ""
+}
+
+// iccCurve returns the tone curve of a curv or para tag, mapping encoded
+// values to linear light, both in [0, 1].
+func iccCurve(t []byte) func(float64) float64 {
+	switch {
+	case len(t) >= 12 && string(t[:4]) == "curv":
+		n := int(binary.BigEndian.Uint32(t[8:]))
+		if 12+2*n > len(t) {
+			return nil
+		}
+		switch n {
+		case 0:
+			return func(x float64) float64 { return x }
+		case 1:
+			g := float64(binary.BigEndian.Uint16(t[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, g) }
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(t[12+2*i:])) / 65535
+		}
+		return func(x float64) float64 {
+			pos := x * float64(n-1)
+			i := min(int(pos), n-2)
+			return table[i] + (table[i+1]-table[i])*(pos-float64(i))
+		}
+	case len(t) >= 16 && string(t[:4]) == "para":
+		counts := []int{1, 3, 4, 5, 7}
+		fn := int(binary.BigEndian.Uint16(t[8:]))
+		if fn >= len(counts) || len(t) < 12+4*counts[fn] {
+			return nil
+		}
+		var p [7]float64
+		for i := 0; i < counts[fn]; i++ {
+			p[i] = s15Fixed16(t[12+4*i:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		switch fn {
+		case 0:
+			return func(x float64) float64 { return math.Pow(x, g) }
+		case 1:
+			return func(x float64) float64 {
+				if x >= -b/a {
+					return math.Pow(a*x+b, g)
+				}
+				return 0
+			}
+		case 2:
+			return func(x float64) float64 {
+				if x >= -b/a {
+					return math.Pow(a*x+b, g) + c
+				}
+				return c
+			}
+		case 3:
+			return func(x float64) float64 {
+				if x >= d {
+					return math.Pow(a*x+b, g)
+				}
+				return c * x
+			}
+		default:
+			return func(x float64) float64 {
+				if x >= d {
+					return math.Pow(a*x+b, g) + e
+				}
+				return c*x + f
+			}
+		}
+	}
+	return nil
+}
+
+// srgbColorants are the colorants of sRGB adapted to D50, as found in the
+// usual sRGB profiles.
+var srgbColorants = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+// srgbToLinear is the sRGB tone curve.
+func srgbToLinear(x float64) float64 {
+	if x <= 0.04045 {
+		return x / 12.92
+	}
+	return math.Pow((x+0.055)/1.055, 2.4)
+}
+
+// isSRGB reports whether the profile is sRGB: same colorants and tone
+// curves as sRGB for matrix/TRC profiles, otherwise judged by its name.
+func (info *iccInfo) isSRGB() bool {
+	if info.Matrix == nil {
+		return info.ColorSpace == "RGB" && strings.Contains(strings.ToLower(info.Description), "srgb")
+	}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			if math.Abs(info.Matrix[i][j]-srgbColorants[i][j]) > 0.002 {
+				return false
+			}
+		}
+	}
+	for c := 0; c < 3; c++ {
+		for v := 0; v <= 255; v += 5 {
+			if math.Abs(info.TRC[c](float64(v)/255)-srgbToLinear(float64(v)/255)) > 0.004 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// name describes the profile in reports.
+func (info *iccInfo) name() string {
+	if info.Description != "" {
+		return info.Description
+	}
+	return "unnamed " + info.ColorSpace + " profile"
+}
+
+// invert3 returns the inverse of m.
+func invert3(m [3][3]float64) [3][3]float64 {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	var inv [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			// Cofactor of m[j][i]
+			a, b := (j+1)%3, (j+2)%3
+			c, d := (i+1)%3, (i+2)%3
+			inv[i][j] = (m[a][c]*m[b][d] - m[a][d]*m[b][c]) / det
+		}
+	}
+	return inv
+}
+
+// convertToSRGB converts img, whose pixels are in the matrix/TRC profile
+// info, to sRGB. Colours outside of the sRGB gamut are clipped.
+func convertToSRGB(img image.Image, info *iccInfo) *image.RGBA {
+	inv := invert3(srgbColorants)
+	var m [3][3]float64 // Source linear RGB to sRGB linear RGB
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += inv[i][k] * info.Matrix[k][j]
+			}
+		}
+	}
+	var toLinear [3][256]float64
+	for c := 0; c < 3; c++ {
+		for v := range toLinear[c] {
+			toLinear[c][v] = info.TRC[c](float64(v) / 255)
+		}
+	}
+	const steps = 4096
+	var toSRGB [steps + 1]uint8
+	for i := range toSRGB {
+		x := float64(i) / steps
+		if x <= 0.0031308 {
+			x *= 12.92
+		} else {
+			x = 1.055*math.Pow(x, 1/2.4) - 0.055
+		}
+		toSRGB[i] = uint8(math.Round(x * 255))
+	}
+	encode := func(x float64) uint8 {
+		return toSRGB[int(math.Round(max(0, min(1, x))*steps))]
+	}
+
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	ycc, _ := img.(*image.YCbCr)
+	for y := 0; y < b.Dy(); y++ {
+		row := dst.Pix[y*dst.Stride:]
+		for x := 0; x < b.Dx(); x++ {
+			var r, g, bl uint8
+			if ycc != nil {
+				ci := ycc.COffset(x+b.Min.X, y+b.Min.Y)
+				r, g, bl = color.YCbCrToRGB(ycc.Y[ycc.YOffset(x+b.Min.X, y+b.Min.Y)], ycc.Cb[ci], ycc.Cr[ci])
+			} else {
+				c := color.RGBAModel.Convert(img.At(x+b.Min.X, y+b.Min.Y)).(color.RGBA)
+				r, g, bl = c.R, c.G, c.B
+			}
+			lr, lg, lb := toLinear[0][r], toLinear[1][g], toLinear[2][bl]
+			row[4*x] = encode(m[0][0]*lr + m[0][1]*lg + m[0][2]*lb)
+			row[4*x+1] = encode(m[1][0]*lr + m[1][1]*lg + m[1][2]*lb)
+			row[4*x+2] = encode(m[2][0]*lr + m[2][1]*lg + m[2][2]*lb)
+			row[4*x+3] = 0xFF
+		}
+	}
+	return dst
+}
+
+// srgbProfile returns a compact ICC v4 sRGB profile (480 bytes):
+// colorants, D65 to D50 adaptation and the parametric sRGB tone curve.
+func srgbProfile() []byte {
+	fixed := func(b *bytes.Buffer, vs ...float64) {
+		for _, v := range vs {
+			binary.Write(b, binary.BigEndian, int32(math.Round(v*65536)))
+		}
+	}
+	mluc := func(s string) []byte {
+		var b bytes.Buffer
+		u := utf16.Encode([]rune(s))
+		b.WriteString("mluc\x00\x00\x00\x00")
+		binary.Write(&b, binary.BigEndian, []uint32{1, 12})
+		b.WriteString("enUS")
+		binary.Write(&b, binary.BigEndian, []uint32{uint32(2 * len(u)), 28})
+		binary.Write(&b, binary.BigEndian, u)
+		return b.Bytes()
+	}
+	xyz := func(x, y, z float64) []byte {
+		var b bytes.Buffer
+		b.WriteString("XYZ \x00\x00\x00\x00")
+		fixed(&b, x, y, z)
+		return b.Bytes()
+	}
+	var chad bytes.Buffer
+	chad.WriteString("sf32\x00\x00\x00\x00")
+	fixed(&chad, 1.047882, 0.022918, -0.050217, 0.029586, 0.990483, -0.017072, -0.009233, 0.015040, 0.752131)
+	var trc bytes.Buffer
+	trc.WriteString("para\x00\x00\x00\x00\x00\x03\x00\x00")
+	fixed(&trc, 2.4, 1/1.055, 0.055/1.055, 1/12.92, 0.04045)
+
+	c := srgbColorants
+	tags := []struct {
+		sig  string
+		data []byte
+	}{
+		{"desc", mluc("sRGB")},
+		{"cprt", mluc("CC0")},
+		{"wtpt", xyz(0.9642, 1, 0.8249)},
+		{"chad", chad.Bytes()},
+		{"rXYZ", xyz(c[0][0], c[1][0], c[2][0])},
+		{"gXYZ", xyz(c[0][1], c[1][1], c[2][1])},
+		{"bXYZ", xyz(c[0][2], c[1][2], c[2][2])},
+		{"rTRC", trc.Bytes()},
+		{"gTRC", nil}, // Shares the red curve
+		{"bTRC", nil},
+	}
+
+	var table, data bytes.Buffer
+	binary.Write(&table, binary.BigEndian, uint32(len(tags)))
+	base := 128 + 4 + 12*len(tags)
+	var trcAt, trcLen int
+	for _, t := range tags {
+		at, length := base+data.Len(), len(t.data)
+		switch {
+		case t.sig == "rTRC":
+			trcAt, trcLen = at, length
+		case t.data == nil:
+			at, length = trcAt, trcLen
+		}
+		table.WriteString(t.sig)
+		binary.Write(&table, binary.BigEndian, []uint32{uint32(at), uint32(length)})
+		data.Write(t.data)
+		for data.Len()%4 != 0 {
+			data.WriteByte(0)
+		}
+	}
+
+	var header bytes.Buffer
+	binary.Write(&header, binary.BigEndian, uint32(base+data.Len()))
+	header.WriteString("\x00\x00\x00\x00")                         // CMM
+	header.Write([]byte{4, 0x30, 0, 0})                            // Version 4.3
+	header.WriteString("mntrRGB XYZ ")                             // Class, colour space, PCS
+	header.Write([]byte{0x07, 0xE8, 0, 1, 0, 1, 0, 0, 0, 0, 0, 0}) // 2024-01-01
+	header.WriteString("acsp")
+	header.Write(make([]byte, 4+4+4+4+8+4)) // Platform, flags, device, attributes, intent
+	fixed(&header, 0.9642, 1, 0.8249)       // PCS illuminant
+	header.Write(make([]byte, 128-header.Len()))
+
+	return append(append(header.Bytes(), table.Bytes()...), data.Bytes()...)
+}
@@ -0,0 +1,111 @@
+package recompress
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"sync"
+)
+
+// SearchCandidate is the outcome of the quality search for one chroma
+// subsampling of a joint search. Quality, Score and Size are not set when
+// no quality in range meets the threshold.
+type SearchCandidate struct {
+	ChromaSubsampling string  `json:"chroma_subsampling"`
+	Quality           int     `json:"quality,omitempty"`
+	Score             float64 `json:"score,omitempty"`
+	Size              int64   `json:"size_bytes,omitempty"`
+	Constraint        string  `json:"constraint,omitempty"`
+	Selected          bool    `json:"selected,omitempty"`
+}
+
+// jointRatios are the subsamplings tried by the joint search, from the
+// full chroma resolution down: on equal sizes the first one wins.
+var jointRatios = []image.YCbCrSubsampleRatio{
+	image.YCbCrSubsampleRatio444,
+	image.YCbCrSubsampleRatio422,
+	image.YCbCrSubsampleRatio420,
+}
+
+// jointSearch runs the quality search for every subsampling of jointRatios
+// in parallel, and returns the smallest encoding meeting the threshold with
+// its subsampling. The traces of the searches are written to opts.Debug one
+// after the other once they are all done.
+func jointSearch(ctx context.Context, img image.Image, encoder Encoder, encOpts EncodeOptions, metric Metric, opts Options, actualSample int, sizeBefore int64) (searchResult, image.YCbCrSubsampleRatio, []SearchCandidate, error) {
+	results := make([]searchResult, len(jointRatios))
+	errs := make([]error, len(jointRatios))
+	traces := make([]bytes.Buffer, len(jointRatios))
+
+	var wg sync.WaitGroup
+	for i, ratio := range jointRatios {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			eo := encOpts
+			eo.ChromaSubsampling = ratio
+			encode := func(buf *bytes.Buffer, q int) error {
+				if err := encoder.Encode(buf, img, q, eo); err != nil {
+					return fmt.Errorf("%s encoder at quality %d, chroma %s: %v", encoder.Name(), q, subsamplingName(ratio), err)
+				}
+				return nil
+			}
+			// The candidates share the threads and the memory budget
+			o := opts
+			o.Threads = max(opts.Threads/len(jointRatios), 1)
+			if opts.MemoryBudget > 0 {
+				o.MemoryBudget = max(opts.MemoryBudget/int64(len(jointRatios)), 1)
+			}
+			if opts.Debug != nil {
+				o.Debug = &traces[i]
+			}
+			results[i], errs[i] = search(ctx, img, encode, metric, o, actualSample, sizeBefore)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return searchResult{}, 0, nil, err
+		}
+	}
+
+	best := -1
+	candidates := make([]SearchCandidate, len(jointRatios))
+	for i, r := range results {
+		candidates[i] = SearchCandidate{ChromaSubsampling: subsamplingName(jointRatios[i])}
+		if r.data == nil {
+			continue
+		}
+		candidates[i].Quality, candidates[i].Score = r.q, r.score
+		candidates[i].Size, candidates[i].Constraint = int64(len(r.data)), r.constraint
+		if best < 0 || len(r.data) < len(results[best].data) {
+			best = i
+		}
+	}
+	if best >= 0 {
+		candidates[best].Selected = true
+	}
+
+	if debug := opts.Debug; debug != nil {
+		for i := range traces {
+			fmt.Fprintf(debug, "[DEBUG] Search with chroma subsampling %s:\n", candidates[i].ChromaSubsampling)
+			debug.Write(traces[i].Bytes())
+		}
+		for _, c := range candidates {
+			if c.Size == 0 {
+				fmt.Fprintf(debug, "[DEBUG] Chroma %s: no quality meets the threshold.\n", c.ChromaSubsampling)
+				continue
+			}
+			mark := ""
+			if c.Selected {
+				mark = " (selected)"
+			}
+			fmt.Fprintf(debug, "[DEBUG] Chroma %s: quality=%d Score=%.6g Size=%s%s\n", c.ChromaSubsampling, c.Quality, c.Score, FormatSize(c.Size), mark)
+		}
+	}
+
+	if best < 0 {
+		return searchResult{}, encOpts.ChromaSubsampling, candidates, nil
+	}
+	return results[best], jointRatios[best], candidates, nil
+}
@@ -0,0 +1,521 @@
+package recompress
+
+import (
+	"errors"
+	"fmt"
+)
+
+// coefComponent holds the quantized DCT coefficients of one component.
+type coefComponent struct {
+	id, h, v, tq byte
+	// bw and bh are the dimensions in blocks of the coefficient array,
+	// padded to whole MCUs; cw and ch only cover the component itself, as
+	// non-interleaved scans do.
+	bw, bh, cw, ch int
+	// blocks holds 64 coefficients per block, in zigzag order.
+	blocks []int16
+}
+
+// block returns the coefficients of block (bx, by).
+func (c *coefComponent) block(bx, by int) []int16 {
+	i := (by*c.bw + bx) * 64
+	return c.blocks[i : i+64]
+}
+
+// jpegCoefs is a JPEG decoded down to its quantized DCT coefficients, the
+// representation that lossless transformations work on.
+type jpegCoefs struct {
+	width, height int
+	precision     byte
+	progressive   bool
+	comps         []*coefComponent
+	hmax, vmax    int
+	mcusX, mcusY  int
+	// dqt holds the DQT segments of the source, marker included.
+	dqt [][]byte
+	// extended is set when a 16-bit quantization table requires SOF1.
+	extended bool
+}
+
+// huffDecoder decodes the symbols of one Huffman table (JPEG Annex F.2.2.3),
+// with a lookup table for the codes of up to 8 bits.
+type huffDecoder struct {
+	maxcode [18]int32
+	valptr  [17]int32
+	mincode [17]int32
+	vals    []byte
+	fast    [256]uint16 // Length << 8 | symbol, 0 if longer than 8 bits
+}
+
+// newHuffDecoder builds a decoder from the 16 code length counts and the
+// symbols of a DHT table.
+func newHuffDecoder(counts []byte, vals []byte) (*huffDecoder, error) {
+	d := &huffDecoder{vals: vals}
+	code, k := int32(0), int32(0)
+	for l := 1; l <= 16; l++ {
+		n := int32(counts[l-1])
+		d.valptr[l] = k
+		d.mincode[l] = code
+		if n == 0 {
+			d.maxcode[l] = -1
+		} else {
+			d.maxcode[l] = code + n - 1
+			if l <= 8 {
+				for i := int32(0); i < n; i++ {
+					c := code + i
+					for j := c << (8 - l); j < (c+1)<<(8-l); j++ {
+						d.fast[j] = uint16(l)<<8 | uint16(vals[k+i])
+					}
+				}
+			}
+		}
+		code = (code + n) << 1
+		k += n
+		if int(k) > len(vals) {
+			return nil, errors.New("jpeg: invalid Huffman table")
+		}
+	}
+	d.maxcode[17] = 0x7FFFFFFF
+	return d, nil
+}
+
+// bitReader reads the entropy-coded data of a scan, removing the stuffed
+// zero bytes. Past the end of the data it reads zeros.
+type bitReader struct {
+	data []byte
+	pos  int
+	acc  uint64 // Bits, MSB first
+	n    uint
+}
+
+func (r *bitReader) fill() {
+	for r.n <= 56 {
+		var b byte
+		if r.pos < len(r.data) {
+			b = r.data[r.pos]
+			if b == 0xFF {
+				if r.pos+1 < len(r.data) && r.data[r.pos+1] == 0x00 {
+					r.pos += 2
+				} else {
+					b = 0 // A marker: stop there
+				}
+			} else {
+				r.pos++
+			}
+		}
+		r.acc |= uint64(b) << (56 - r.n)
+		r.n += 8
+	}
+}
+
+func (r *bitReader) bits(n uint) int32 {
+	if n == 0 {
+		return 0
+	}
+	if r.n < n {
+		r.fill()
+	}
+	v := int32(r.acc >> (64 - n))
+	r.acc <<= n
+	r.n -= n
+	return v
+}
+
+// receiveExtend reads an s-bit magnitude and extends its sign (F.2.2.1).
+func (r *bitReader) receiveExtend(s uint) int32 {
+	v := r.bits(s)
+	if s > 0 && v < 1<<(s-1) {
+		v += -1<<s + 1
+	}
+	return v
+}
+
+func (r *bitReader) decode(d *huffDecoder) (byte, error) {
+	if r.n < 16 {
+		r.fill()
+	}
+	if f := d.fast[r.acc>>56]; f != 0 {
+		r.acc <<= f >> 8
+		r.n -= uint(f >> 8)
+		return byte(f), nil
+	}
+	code := int32(0)
+	for l := 1; l <= 16; l++ {
+		code = code<<1 | int32(r.acc>>63)
+		r.acc <<= 1
+		r.n--
+		if code <= d.maxcode[l] {
+			return d.vals[d.valptr[l]+code-d.mincode[l]], nil
+		}
+	}
+	return 0, errors.New("jpeg: invalid Huffman code")
+}
+
+// restart skips the RSTn marker expected at the current position.
+func (r *bitReader) restart() {
+	r.acc, r.n = 0, 0
+	for r.pos+1 < len(r.data) {
+		if r.data[r.pos] == 0xFF && r.data[r.pos+1] >= 0xD0 && r.data[r.pos+1] <= 0xD7 {
+			r.pos += 2
+			return
+		}
+		r.pos++
+	}
+}
+
+// decodeCoefficients decodes the primary image of the JPEG data down to its
+// quantized DCT coefficients. Huffman-coded baseline, extended and
+// progressive 8-bit JPEGs are supported.
+func decodeCoefficients(data []byte) (*jpegCoefs, error) {
+	j := &jpegCoefs{}
+	var dc, ac [4]*huffDecoder
+	restartInterval := 0
+	var err error
+	end := walkSegments(data, func(marker byte, seg []byte) bool {
+		if err != nil {
+			return false
+		}
+		payload := seg[4:]
+		switch {
+		case marker == 0xDB:
+			j.dqt = append(j.dqt, seg)
+			for p := payload; len(p) > 0; {
+				size := 65
+				if p[0]>>4 != 0 {
+					size, j.extended = 129, true
+				}
+				if len(p) < size {
+					err = errors.New("jpeg: invalid DQT")
+					return false
+				}
+				p = p[size:]
+			}
+		case marker == 0xC4:
+			for p := payload; len(p) > 0; {
+				if len(p) < 17 {
+					err = errors.New("jpeg: invalid DHT")
+					return false
+				}
+				n := 0
+				for _, c := range p[1:17] {
+					n += int(c)
+				}
+				if len(p) < 17+n || p[0]&0x0F > 3 {
+					err = errors.New("jpeg: invalid DHT")
+					return false
+				}
+				var d *huffDecoder
+				if d, err = newHuffDecoder(p[1:17], p[17:17+n]); err != nil {
+					return false
+				}
+				if p[0]>>4 == 0 {
+					dc[p[0]&3] = d
+				} else {
+					ac[p[0]&3] = d
+				}
+				p = p[17+n:]
+			}
+		case marker == 0xDD:
+			if len(payload) >= 2 {
+				restartInterval = int(payload[0])<<8 | int(payload[1])
+			}
+		case marker == 0xC0 || marker == 0xC1 || marker == 0xC2:
+			err = j.parseFrame(marker, payload)
+		case marker >= 0xC3 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC:
+			err = fmt.Errorf("jpeg: unsupported coding process (SOF%d)", marker-0xC0)
+		case marker == 0xDA:
+			if j.comps == nil {
+				err = errors.New("jpeg: scan before frame")
+				return false
+			}
+			// The entropy-coded data follows the header, up to the next
+			// marker that is not a restart marker
+			start := cap(data) - cap(seg) + len(seg)
+			stop := start
+			for stop < len(data)-1 && !(data[stop] == 0xFF && data[stop+1] != 0 && (data[stop+1] < 0xD0 || data[stop+1] > 0xD7)) {
+				stop++
+			}
+			err = j.decodeScan(payload, data[start:stop], dc, ac, restartInterval)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if end < 0 || j.comps == nil {
+		return nil, errors.New("jpeg: truncated image")
+	}
+	return j, nil
+}
+
+func (j *jpegCoefs) parseFrame(marker byte, p []byte) error {
+	if j.comps != nil {
+		return errors.New("jpeg: multiple frames")
+	}
+	if len(p) < 6 {
+		return errors.New("jpeg: invalid SOF")
+	}
+	j.precision = p[0]
+	j.height = int(p[1])<<8 | int(p[2])
+	j.width = int(p[3])<<8 | int(p[4])
+	j.progressive = marker == 0xC2
+	n := int(p[5])
+	if j.precision != 8 {
+		return fmt.Errorf("jpeg: unsupported precision %d", j.precision)
+	}
+	if j.width == 0 || j.height == 0 || n == 0 || n > 4 || len(p) < 6+3*n {
+		return errors.New("jpeg: invalid SOF")
+	}
+	for i := 0; i < n; i++ {
+		c := &coefComponent{id: p[6+3*i], h: p[7+3*i] >> 4, v: p[7+3*i] & 0x0F, tq: p[8+3*i]}
+		if c.h < 1 || c.h > 4 || c.v < 1 || c.v > 4 {
+			return errors.New("jpeg: invalid sampling factors")
+		}
+		j.comps = append(j.comps, c)
+	}
+	j.layout()
+	return nil
+}
+
+// layout sizes the MCU grid and allocates the coefficients of the
+// components, once the dimensions and sampling factors are known.
+func (j *jpegCoefs) layout() {
+	j.hmax, j.vmax = 1, 1
+	for _, c := range j.comps {
+		j.hmax, j.vmax = max(j.hmax, int(c.h)), max(j.vmax, int(c.v))
+	}
+	j.mcusX = (j.width + 8*j.hmax - 1) / (8 * j.hmax)
+	j.mcusY = (j.height + 8*j.vmax - 1) / (8 * j.vmax)
+	for _, c := range j.comps {
+		c.bw, c.bh = j.mcusX*int(c.h), j.mcusY*int(c.v)
+		c.cw = ((j.width*int(c.h)+j.hmax-1)/j.hmax + 7) / 8
+		c.ch = ((j.height*int(c.v)+j.vmax-1)/j.vmax + 7) / 8
+		c.blocks = make([]int16, 64*c.bw*c.bh)
+	}
+}
+
+// decodeScan decodes one scan, whose header is p and entropy-coded data is
+// data, into the coefficients.
+func (j *jpegCoefs) decodeScan(p, data []byte, dc, ac [4]*huffDecoder, restartInterval int) error {
+	if len(p) < 1 || len(p) < 1+2*int(p[0])+3 {
+		return errors.New("jpeg: invalid SOS")
+	}
+	n := int(p[0])
+	comps := make([]*coefComponent, n)
+	dcs, acs := make([]*huffDecoder, n), make([]*huffDecoder, n)
+	for i := 0; i < n; i++ {
+		for _, c := range j.comps {
+			if c.id == p[1+2*i] {
+				comps[i] = c
+			}
+		}
+		if comps[i] == nil {
+			return errors.New("jpeg: scan of an unknown component")
+		}
+		dcs[i], acs[i] = dc[p[2+2*i]>>4], ac[p[2+2*i]&3]
+	}
+	ss, se := int(p[1+2*n]), int(p[2+2*n])
+	ah, al := uint(p[3+2*n]>>4), uint(p[3+2*n]&0x0F)
+	if !j.progressive {
+		ss, se, ah, al = 0, 63, 0, 0
+	}
+	if ss > se || se > 63 || (ss == 0 && se != 0 && j.progressive) || (ss > 0 && n != 1) {
+		return errors.New("jpeg: invalid progressive scan")
+	}
+	for i := range comps {
+		if (ss == 0 && ah == 0 && dcs[i] == nil) || (se > 0 && acs[i] == nil) {
+			return errors.New("jpeg: missing Huffman table")
+		}
+	}
+
+	r := &bitReader{data: data}
+	preds := make([]int32, n)
+	eobrun := 0
+	decodeBlock := func(i int, blk []int16) error {
+		if ss == 0 {
+			if ah == 0 {
+				t, err := r.decode(dcs[i])
+				if err != nil {
+					return err
+				}
+				if t > 11 {
+					return errors.New("jpeg: invalid DC difference")
+				}
+				preds[i] += r.receiveExtend(uint(t))
+				blk[0] = int16(preds[i] << al)
+			} else if r.bits(1) != 0 {
+				blk[0] |= 1 << al
+			}
+			if se == 0 {
+				return nil
+			}
+		}
+		if !j.progressive {
+			return decodeSequentialAC(r, acs[i], blk)
+		}
+		if ah == 0 {
+			return decodeACFirst(r, acs[i], blk, ss, se, al, &eobrun)
+		}
+		return decodeACRefine(r, acs[i], blk, ss, se, al, &eobrun)
+	}
+
+	units, unitsX := 0, 0 // MCUs, or blocks of a non-interleaved scan
+	if n == 1 {
+		unitsX = comps[0].cw
+		units = unitsX * comps[0].ch
+	} else {
+		unitsX = j.mcusX
+		units = unitsX * j.mcusY
+	}
+	for u := 0; u < units; u++ {
+		if restartInterval > 0 && u > 0 && u%restartInterval == 0 {
+			r.restart()
+			clear(preds)
+			eobrun = 0
+		}
+		ux, uy := u%unitsX, u/unitsX
+		if n == 1 {
+			if err := decodeBlock(0, comps[0].block(ux, uy)); err != nil {
+				return err
+			}
+			continue
+		}
+		for i, c := range comps {
+			for y := 0; y < int(c.v); y++ {
+				for x := 0; x < int(c.h); x++ {
+					if err := decodeBlock(i, c.block(ux*int(c.h)+x, uy*int(c.v)+y)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func decodeSequentialAC(r *bitReader, d *huffDecoder, blk []int16) error {
+	for k := 1; k < 64; {
+		rs, err := r.decode(d)
+		if err != nil {
+			return err
+		}
+		run, s := int(rs>>4), uint(rs&0x0F)
+		if s == 0 {
+			if run != 15 {
+				return nil // EOB
+			}
+			k += 16
+			continue
+		}
+		k += run
+		if k > 63 {
+			return errors.New("jpeg: too many coefficients")
+		}
+		blk[k] = int16(r.receiveExtend(s))
+		k++
+	}
+	return nil
+}
+
+// decodeACFirst decodes the first scan of a spectral band (G.1.2.2).
+func decodeACFirst(r *bitReader, d *huffDecoder, blk []int16, ss, se int, al uint, eobrun *int) error {
+	if *eobrun > 0 {
+		*eobrun--
+		return nil
+	}
+	for k := ss; k <= se; {
+		rs, err := r.decode(d)
+		if err != nil {
+			return err
+		}
+		run, s := int(rs>>4), uint(rs&0x0F)
+		if s == 0 {
+			if run < 15 {
+				*eobrun = 1<<run - 1
+				if run > 0 {
+					*eobrun += int(r.bits(uint(run)))
+				}
+				return nil
+			}
+			k += 16
+			continue
+		}
+		k += run
+		if k > se {
+			return errors.New("jpeg: too many coefficients")
+		}
+		blk[k] = int16(r.receiveExtend(s) << al)
+		k++
+	}
+	return nil
+}
+
+// decodeACRefine decodes a successive approximation refinement scan of a
+// spectral band (G.1.2.3).
+func decodeACRefine(r *bitReader, d *huffDecoder, blk []int16, ss, se int, al uint, eobrun *int) error {
+	p1, m1 := int16(1)<<al, int16(-1)<<al
+	refine := func(coef *int16) {
+		if r.bits(1) != 0 && *coef&p1 == 0 {
+			if *coef >= 0 {
+				*coef += p1
+			} else {
+				*coef += m1
+			}
+		}
+	}
+	k := ss
+	if *eobrun == 0 {
+		for ; k <= se; k++ {
+			rs, err := r.decode(d)
+			if err != nil {
+				return err
+			}
+			run, s := int(rs>>4), int16(0)
+			switch rs & 0x0F {
+			case 0:
+				if run != 15 {
+					*eobrun = 1 << run
+					if run > 0 {
+						*eobrun += int(r.bits(uint(run)))
+					}
+				}
+			case 1:
+				s = m1
+				if r.bits(1) != 0 {
+					s = p1
+				}
+			default:
+				return errors.New("jpeg: invalid refinement symbol")
+			}
+			if *eobrun > 0 {
+				break
+			}
+			// Refine the non-zero coefficients up to the run-th zero one
+			for ; k <= se; k++ {
+				if blk[k] != 0 {
+					refine(&blk[k])
+				} else {
+					if run == 0 {
+						break
+					}
+					run--
+				}
+			}
+			if s != 0 {
+				if k > se {
+					return errors.New("jpeg: too many coefficients")
+				}
+				blk[k] = s
+			}
+		}
+	}
+	if *eobrun > 0 {
+		for ; k <= se; k++ {
+			if blk[k] != 0 {
+				refine(&blk[k])
+			}
+		}
+		*eobrun--
+	}
+	return nil
+}
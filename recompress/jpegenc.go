@@ -0,0 +1,211 @@
+package recompress
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// zigzag maps the zigzag order of the coefficients to their natural order.
+var zigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// quantTables scales the Annex K tables to quality as image/jpeg does.
+func quantTables(quality int) [2][64]byte {
+	quality = min(max(quality, 1), 100)
+	var q [2][64]byte
+	for t := range q {
+		for k, v := range ijgTable(ijgQuant[t], quality) {
+			q[t][k] = byte(v)
+		}
+	}
+	return q
+}
+
+// Huffman tables of JPEG Annex K.3, which image/jpeg always uses: luma and
+// chroma, DC and AC.
+var stdDCTables, stdACTables = func() ([2]*huffTable, [2]*huffTable) {
+	table := func(counts [16]byte, vals []byte) *huffTable {
+		t := &huffTable{counts: counts, vals: vals}
+		t.assignCodes()
+		return t
+	}
+	acLuma := []byte{
+		0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12, 0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+		0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08, 0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+		0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+		0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+		0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+		0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+		0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+		0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+		0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+		0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+		0xf9, 0xfa,
+	}
+	acChroma := []byte{
+		0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21, 0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+		0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91, 0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+		0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34, 0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+		0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+		0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+		0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+		0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+		0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+		0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+		0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+		0xf9, 0xfa,
+	}
+	dcVals := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}
+	dc := [2]*huffTable{
+		table([16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0}, dcVals),
+		table([16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0}, dcVals),
+	}
+	ac := [2]*huffTable{
+		table([16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125}, acLuma),
+		table([16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119}, acChroma),
+	}
+	return dc, ac
+}()
+
+// samplingFactors returns the horizontal and vertical sampling factors of
+// the luma for ratio, the chroma being sampled once per MCU.
+func samplingFactors(ratio image.YCbCrSubsampleRatio) (byte, byte) {
+	switch ratio {
+	case image.YCbCrSubsampleRatio422:
+		return 2, 1
+	case image.YCbCrSubsampleRatio420:
+		return 2, 2
+	}
+	return 1, 1
+}
+
+// encodeYCbCr computes the quantized DCT coefficients of img as a YCbCr
+// JPEG with the chroma subsampling ratio (444, 422 or 420) and the
+// quantization tables of image/jpeg at quality. As image/jpeg, the image
+// is extended by repeating its edges, and subsampled chroma is the
+// rounded average of the full resolution chroma.
+func encodeYCbCr(img image.Image, quality int, ratio image.YCbCrSubsampleRatio) *jpegCoefs {
+	b := img.Bounds()
+	h, v := samplingFactors(ratio)
+	j := &jpegCoefs{width: b.Dx(), height: b.Dy(), precision: 8, comps: []*coefComponent{
+		{id: 1, h: h, v: v, tq: 0},
+		{id: 2, h: 1, v: 1, tq: 1},
+		{id: 3, h: 1, v: 1, tq: 1},
+	}}
+	j.layout()
+	q := quantTables(quality)
+	dqt := []byte{0xFF, 0xDB, 0, 2 + 2*65, 0}
+	dqt = append(append(append(dqt, q[0][:]...), 1), q[1][:]...)
+	j.dqt = [][]byte{dqt}
+
+	// Full resolution planes over the whole MCUs
+	pw, ph := j.mcusX*8*int(h), j.mcusY*8*int(v)
+	planes := [3][]uint8{make([]uint8, pw*ph), make([]uint8, pw*ph), make([]uint8, pw*ph)}
+	for y := 0; y < ph; y++ {
+		sy := b.Min.Y + min(y, b.Dy()-1)
+		for x := 0; x < pw; x++ {
+			sx := b.Min.X + min(x, b.Dx()-1)
+			var yy, cb, cr uint8
+			switch m := img.(type) {
+			case *image.YCbCr:
+				yi, ci := m.YOffset(sx, sy), m.COffset(sx, sy)
+				yy, cb, cr = m.Y[yi], m.Cb[ci], m.Cr[ci]
+			case *image.RGBA:
+				p := m.Pix[m.PixOffset(sx, sy):]
+				yy, cb, cr = color.RGBToYCbCr(p[0], p[1], p[2])
+			default:
+				r, g, bl, _ := img.At(sx, sy).RGBA()
+				yy, cb, cr = color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(bl>>8))
+			}
+			i := y*pw + x
+			planes[0][i], planes[1][i], planes[2][i] = yy, cb, cr
+		}
+	}
+
+	var samples [64]float32
+	for ci, c := range j.comps {
+		// Each sample of the component averages sx × sy plane pixels
+		sx, sy := int(h)/int(c.h), int(v)/int(c.v)
+		n := sx * sy
+		plane := planes[ci]
+		qt := &q[c.tq]
+		for by := 0; by < c.bh; by++ {
+			for bx := 0; bx < c.bw; bx++ {
+				for y := 0; y < 8; y++ {
+					for x := 0; x < 8; x++ {
+						px, py := (bx*8+x)*sx, (by*8+y)*sy
+						sum := 0
+						for dy := 0; dy < sy; dy++ {
+							for dx := 0; dx < sx; dx++ {
+								sum += int(plane[(py+dy)*pw+px+dx])
+							}
+						}
+						// Rounded average, as image/jpeg
+						samples[y*8+x] = float32((sum+n/2)/n) - 128
+					}
+				}
+				fdct(&samples)
+				blk := c.block(bx, by)
+				for k, i := range zigzag {
+					blk[k] = int16(math.Round(float64(samples[i] / (float32(qt[k]) * 8 * aanScale[i>>3] * aanScale[i&7]))))
+				}
+			}
+		}
+	}
+	return j
+}
+
+// aanScale are the scale factors of the outputs of fdct: cos(k·π/16)·√2,
+// 1 for k = 0.
+var aanScale = [8]float32{1, 1.387039845, 1.306562965, 1.175875602, 1, 0.785694958, 0.541196100, 0.275899379}
+
+// fdct is the floating point forward DCT of Arai, Agui and Nakajima, as
+// libjpeg's jfdctflt: output (u, v) is scaled by 8·aanScale[u]·aanScale[v].
+func fdct(d *[64]float32) {
+	pass := func(i0, step int) {
+		d0, d1, d2, d3 := d[i0], d[i0+step], d[i0+2*step], d[i0+3*step]
+		d4, d5, d6, d7 := d[i0+4*step], d[i0+5*step], d[i0+6*step], d[i0+7*step]
+		tmp0, tmp7 := d0+d7, d0-d7
+		tmp1, tmp6 := d1+d6, d1-d6
+		tmp2, tmp5 := d2+d5, d2-d5
+		tmp3, tmp4 := d3+d4, d3-d4
+
+		// Even part
+		tmp10, tmp13 := tmp0+tmp3, tmp0-tmp3
+		tmp11, tmp12 := tmp1+tmp2, tmp1-tmp2
+		d[i0] = tmp10 + tmp11
+		d[i0+4*step] = tmp10 - tmp11
+		z1 := (tmp12 + tmp13) * 0.707106781
+		d[i0+2*step] = tmp13 + z1
+		d[i0+6*step] = tmp13 - z1
+
+		// Odd part
+		tmp10 = tmp4 + tmp5
+		tmp11 = tmp5 + tmp6
+		tmp12 = tmp6 + tmp7
+		z5 := (tmp10 - tmp12) * 0.382683433
+		z2 := 0.541196100*tmp10 + z5
+		z4 := 1.306562965*tmp12 + z5
+		z3 := tmp11 * 0.707106781
+		z11, z13 := tmp7+z3, tmp7-z3
+		d[i0+5*step] = z13 + z2
+		d[i0+3*step] = z13 - z2
+		d[i0+step] = z11 + z4
+		d[i0+7*step] = z11 - z4
+	}
+	for row := 0; row < 8; row++ {
+		pass(row*8, 1)
+	}
+	for col := 0; col < 8; col++ {
+		pass(col, 8)
+	}
+}
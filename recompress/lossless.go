@@ -0,0 +1,99 @@
+package recompress
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+)
+
+// optimizeJPEG rewrites the primary JPEG data without changing its pixels,
+// like jpegtran -optimize: the quantized DCT coefficients are kept and
+// re-encoded as a single baseline scan with optimal Huffman tables, or as a
+// progressive JPEG. The result holds no metadata; it is decoded and
+// compared to the source before being returned.
+func optimizeJPEG(data []byte, progressive bool) ([]byte, error) {
+	coefs, err := decodeCoefficients(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(coefs.comps) != 1 && len(coefs.comps) != 3 {
+		return nil, errors.New("lossless: only grayscale and YCbCr JPEGs are supported")
+	}
+	if len(coefs.comps) == 3 && adobeTransform(data) == 0 {
+		// RGB coded: the colours depend on the APP14 segment, which
+		// metadata policies may drop
+		return nil, errors.New("lossless: Adobe RGB coded JPEG")
+	}
+	blocks := 0
+	for _, c := range coefs.comps {
+		blocks += int(c.h * c.v)
+	}
+	if len(coefs.comps) > 1 && blocks > 10 {
+		return nil, errors.New("lossless: too many blocks per MCU for a baseline scan")
+	}
+	out := coefs.encodeBaseline()
+	if progressive {
+		out = coefs.encodeProgressive()
+	}
+	if err := samePixels(data, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// adobeTransform returns the color transform of the Adobe APP14 segment of
+// data, or -1 if there is none.
+func adobeTransform(data []byte) int {
+	transform := -1
+	walkSegments(data, func(marker byte, seg []byte) bool {
+		if marker == 0xDA {
+			return false
+		}
+		if segmentIdentifier(seg) == "Adobe" && len(seg) >= 16 {
+			transform = int(seg[15])
+		}
+		return true
+	})
+	return transform
+}
+
+// samePixels checks that two JPEGs decode to the same pixels. Only the
+// image itself is compared: the decoders pad their buffers to whole MCUs,
+// which progressive scans do not code.
+func samePixels(a, b []byte) error {
+	imgA, err := jpeg.Decode(bytes.NewReader(a))
+	if err != nil {
+		return err
+	}
+	imgB, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	same := false
+	switch pa := imgA.(type) {
+	case *image.YCbCr:
+		pb, ok := imgB.(*image.YCbCr)
+		same = ok && pa.Rect == pb.Rect && pa.SubsampleRatio == pb.SubsampleRatio
+		r := pa.Rect
+		for y := r.Min.Y; same && y < r.Max.Y; y++ {
+			ya, yb := pa.YOffset(r.Min.X, y), pb.YOffset(r.Min.X, y)
+			ca, cb := pa.COffset(r.Min.X, y), pb.COffset(r.Min.X, y)
+			cn := pa.COffset(r.Max.X-1, y) - ca + 1
+			same = bytes.Equal(pa.Y[ya:ya+r.Dx()], pb.Y[yb:yb+r.Dx()]) &&
+				bytes.Equal(pa.Cb[ca:ca+cn], pb.Cb[cb:cb+cn]) && bytes.Equal(pa.Cr[ca:ca+cn], pb.Cr[cb:cb+cn])
+		}
+	case *image.Gray:
+		pb, ok := imgB.(*image.Gray)
+		same = ok && pa.Rect == pb.Rect
+		r := pa.Rect
+		for y := r.Min.Y; same && y < r.Max.Y; y++ {
+			ia, ib := pa.PixOffset(r.Min.X, y), pb.PixOffset(r.Min.X, y)
+			same = bytes.Equal(pa.Pix[ia:ia+r.Dx()], pb.Pix[ib:ib+r.Dx()])
+		}
+	}
+	if !same {
+		return errors.New("lossless: pixels differ from the source")
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package recompress
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"testing"
+)
+
+// testGrayJPEG encodes a w x h grey texture with image/jpeg at quality.
+func testGrayJPEG(t *testing.T, w, h, quality int) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetGray(x, y, color.Gray{uint8(x*2 + y + (x*y)%29*3)})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// jpegPixels decodes data with image/jpeg, as RGBA.
+func jpegPixels(t *testing.T, data []byte) *image.RGBA {
+	t.Helper()
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Rect, img, img.Bounds().Min, draw.Src)
+	return rgba
+}
+
+// withRestarts rewrites the JPEG data as a baseline JPEG with a DRI
+// segment and a restart marker every interval MCUs (blocks, for a single
+// component), coded with optimal Huffman tables.
+func withRestarts(t *testing.T, data []byte, interval int) []byte {
+	t.Helper()
+	j, err := decodeCoefficients(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comps := make([]int, len(j.comps))
+	perUnit := 0
+	for i, c := range j.comps {
+		comps[i] = i
+		perUnit += int(c.h * c.v)
+	}
+	if len(comps) == 1 {
+		perUnit = 1
+	}
+	// scan is sequentialScan with the DC predictions reset at each
+	// restart, before which it calls restart with the marker number
+	scan := func(fn func(t int, blk []int16, pred int32), restart func(n int)) {
+		preds := make([]int32, len(j.comps))
+		blocks := 0
+		j.eachBlock(comps, func(i int, blk []int16) {
+			if blocks > 0 && blocks%(perUnit*interval) == 0 {
+				clear(preds)
+				restart((blocks/(perUnit*interval) - 1) % 8)
+			}
+			blocks++
+			fn(min(i, 1), blk, preds[i])
+			preds[i] = int32(blk[0])
+		})
+	}
+
+	var dcFreq, acFreq [2][256]int64
+	scan(func(t int, blk []int16, pred int32) {
+		blockSymbols(blk, pred,
+			func(sym byte, _ uint32, _ uint) { dcFreq[t][sym]++ },
+			func(sym byte, _ uint32, _ uint) { acFreq[t][sym]++ })
+	}, func(int) {})
+	var out bytes.Buffer
+	j.writeFrame(&out, 0xC0)
+	var dc, ac [2]*huffTable
+	var dht []byte
+	for t := 0; t < min(len(j.comps), 2); t++ {
+		dc[t], ac[t] = optimalHuffTable(&dcFreq[t]), optimalHuffTable(&acFreq[t])
+		dht = append(dht, dhtTable(0, t, dc[t])...)
+		dht = append(dht, dhtTable(1, t, ac[t])...)
+	}
+	writeSegment(&out, 0xC4, dht)
+	writeSegment(&out, 0xDD, []byte{byte(interval >> 8), byte(interval)})
+	sos := []byte{byte(len(j.comps))}
+	for i, c := range j.comps {
+		t := byte(min(i, 1))
+		sos = append(sos, c.id, t<<4|t)
+	}
+	writeSegment(&out, 0xDA, append(sos, 0, 63, 0))
+
+	w := &bitWriter{buf: &out}
+	scan(func(t int, blk []int16, pred int32) {
+		blockSymbols(blk, pred,
+			func(sym byte, v uint32, n uint) {
+				w.write(uint32(dc[t].code[sym]), uint(dc[t].size[sym]))
+				w.write(v, n)
+			},
+			func(sym byte, v uint32, n uint) {
+				w.write(uint32(ac[t].code[sym]), uint(ac[t].size[sym]))
+				w.write(v, n)
+			})
+	}, func(n int) {
+		w.flush()
+		out.Write([]byte{0xFF, 0xD0 + byte(n)})
+	})
+	w.flush()
+	out.Write([]byte{0xFF, 0xD9})
+	return out.Bytes()
+}
+
+// TestLosslessRoundTrip checks that decoding the coefficients of a JPEG
+// and writing them back, as is or through optimizeJPEG, gives the pixels of
+// the source as decoded by image/jpeg, in no more bytes.
+func TestLosslessRoundTrip(t *testing.T) {
+	gray := testGrayJPEG(t, 100, 75, 85)
+	ycc420 := testJPEG(t, 100, 75, 85)
+	ycc444 := encodeYCbCr(jpegPixels(t, ycc420), 85, image.YCbCrSubsampleRatio444).encodeBaseline()
+	tests := []struct {
+		name  string
+		src   []byte
+		comps int
+		h, v  byte // Of the first component
+	}{
+		{"grayscale", gray, 1, 1, 1},
+		{"4:2:0", ycc420, 3, 2, 2},
+		{"4:4:4", ycc444, 3, 1, 1},
+		{"grayscale restarts", withRestarts(t, gray, 7), 1, 1, 1},
+		{"4:2:0 restarts", withRestarts(t, ycc420, 3), 3, 2, 2},
+	}
+	for _, tt := range tests {
+		coefs, err := decodeCoefficients(tt.src)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if c := coefs.comps[0]; len(coefs.comps) != tt.comps || c.h != tt.h || c.v != tt.v {
+			t.Fatalf("%s: %d components, sampling %dx%d; want %d, %dx%d", tt.name, len(coefs.comps), c.h, c.v, tt.comps, tt.h, tt.v)
+		}
+		want := jpegPixels(t, tt.src)
+		optimized, err := optimizeJPEG(tt.src, false)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for _, out := range [][]byte{coefs.encodeBaseline(), optimized} {
+			if got := jpegPixels(t, out); got.Rect != want.Rect || !bytes.Equal(got.Pix, want.Pix) {
+				t.Errorf("%s: pixels differ from the source", tt.name)
+			}
+			if len(out) > len(tt.src) {
+				t.Errorf("%s: %d bytes, larger than the %d of the source", tt.name, len(out), len(tt.src))
+			}
+		}
+	}
+}
+
+// TestRestartFixture checks the JPEGs of withRestarts: restart markers
+// are written, and image/jpeg decodes them to the pixels of the source.
+func TestRestartFixture(t *testing.T) {
+	for _, src := range [][]byte{testGrayJPEG(t, 100, 75, 85), testJPEG(t, 100, 75, 85)} {
+		rst := withRestarts(t, src, 3)
+		if !bytes.Contains(rst, []byte{0xFF, 0xDD}) || !bytes.Contains(rst, []byte{0xFF, 0xD7}) {
+			t.Error("no restart markers")
+		}
+		if got, want := jpegPixels(t, rst), jpegPixels(t, src); !bytes.Equal(got.Pix, want.Pix) {
+			t.Error("pixels differ from the source")
+		}
+	}
+}
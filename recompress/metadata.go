@@ -0,0 +1,228 @@
+package recompress
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// isJPEG reports whether data starts with a JPEG SOI marker.
+func isJPEG(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0xFF && data[1] == 0xD8
+}
+
+// walkSegments calls fn with the marker and the bytes (marker included) of
+// every marker segment of the primary image in data, in file order, until
+// fn returns false. Entropy-coded scan data is skipped. It returns the
+// offset just past the EOI marker, or -1 if the walk stopped before it.
+func walkSegments(data []byte, fn func(marker byte, seg []byte) bool) int {
+	if !isJPEG(data) {
+		return -1
+	}
+	for i := 2; i < len(data)-1; {
+		if data[i] != 0xFF {
+			i++
+			continue
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xFF: // Fill byte
+			i++
+			continue
+		case marker == 0xD9: // EOI
+			return i + 2
+		case marker == 0x00 || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7): // No length
+			i += 2
+			continue
+		}
+		if i+3 >= len(data) {
+			return -1
+		}
+		length := int(data[i+2])<<8 | int(data[i+3])
+		if length < 2 || i+2+length > len(data) {
+			return -1
+		}
+		if !fn(marker, data[i:i+2+length]) {
+			return -1
+		}
+		i += 2 + length
+		if marker != 0xDA {
+			continue
+		}
+		// Skip the entropy-coded data of the scan: it ends at the first
+		// marker that is neither a stuffed 0xFF00 nor a restart marker.
+		for i < len(data)-1 {
+			if data[i] == 0xFF {
+				next := data[i+1]
+				if next != 0x00 && next != 0xFF && (next < 0xD0 || next > 0xD7) {
+					break
+				}
+			}
+			i++
+		}
+	}
+	return -1
+}
+
+// isMetadataMarker reports whether marker starts a segment that carries no
+// image data: APPn, COM and the reserved JPGn extensions.
+func isMetadataMarker(marker byte) bool {
+	return (marker >= 0xE0 && marker <= 0xEF) || (marker >= 0xF0 && marker <= 0xFE)
+}
+
+// appIdentifiers maps the payload prefix of well-known APPn segments to the
+// name used in reports.
+var appIdentifiers = []struct {
+	marker byte
+	prefix string
+	name   string
+}{
+	{0xE0, "JFIF\x00", "JFIF"},
+	{0xE0, "JFXX\x00", "JFXX"},
+	{0xE1, "Exif\x00", "Exif"},
+	{0xE1, "http://ns.adobe.com/xap/1.0/\x00", "XMP"},
+	{0xE1, "http://ns.adobe.com/xmp/extension/\x00", "ExtendedXMP"},
+	{0xE2, "ICC_PROFILE\x00", "ICC_PROFILE"},
+	{0xE2, "MPF\x00", "MPF"},
+	{0xE2, "FPXR\x00", "FPXR"},
+	{0xEC, "Ducky", "Ducky"},
+	{0xED, "Photoshop 3.0\x00", "Photoshop"},
+	{0xEE, "Adobe", "Adobe"},
+}
+
+// segmentIdentifier returns the name of the well-known payload of seg
+// (Exif, XMP, ICC_PROFILE...), or "" if it is not recognised.
+func segmentIdentifier(seg []byte) string {
+	for _, id := range appIdentifiers {
+		if seg[1] == id.marker && bytes.HasPrefix(seg[4:], []byte(id.prefix)) {
+			return id.name
+		}
+	}
+	return ""
+}
+
+// segmentName describes seg for reports, e.g. APP1:Exif, APP13 or COM.
+func segmentName(seg []byte) string {
+	marker := seg[1]
+	var name string
+	switch {
+	case marker == 0xFE:
+		return "COM"
+	case marker >= 0xF0:
+		name = fmt.Sprintf("JPG%d", marker-0xF0)
+	default:
+		name = fmt.Sprintf("APP%d", marker-0xE0)
+	}
+	if id := segmentIdentifier(seg); id != "" {
+		name += ":" + id
+	}
+	return name
+}
+
+// colorHandling tells transplantMetadata what happened to the ICC profile
+// of the source.
+type colorHandling struct {
+	// converted is set when the pixels were converted to sRGB: the source
+	// profile is replaced by the segments of profile (none if empty).
+	converted bool
+	profile   [][]byte
+	// protect names a non-sRGB source profile that is kept even if the
+	// policy strips it, since the colours depend on it.
+	protect string
+}
+
+// transplantMetadata rebuilds the JPEG dstData with the non-image segments
+// of srcData (APPn, COM, JPGn) that policy keeps, possibly scrubbed, and
+// the APP15 signature sig. The ICC profile is handled according to icc.
+// It returns the new JPEG and the decision taken for every source segment.
+func transplantMetadata(srcData, dstData []byte, policy *MetadataPolicy, icc colorHandling, sig *SignatureInfo) ([]byte, []MetadataDecision) {
+	var segments [][]byte
+	var decisions []MetadataDecision
+	walkSegments(srcData, func(marker byte, segment []byte) bool {
+		if !isMetadataMarker(marker) {
+			return true
+		}
+		// Previous signatures are replaced, not dropped
+		if parseSignature(segment, append([]string{sig.Tool}, knownSignatures...)) != nil {
+			return true
+		}
+		isICC := segmentIdentifier(segment) == "ICC_PROFILE"
+		if isICC && icc.converted {
+			decisions = append(decisions, MetadataDecision{Segment: segmentName(segment), Size: len(segment),
+				Action: "removed", Reason: "pixels converted to sRGB"})
+			// The replacement goes where the source profile was
+			for _, seg := range icc.profile {
+				if out, _ := policy.apply(seg); out != nil {
+					segments = append(segments, out)
+				}
+			}
+			icc.profile = nil
+			return true
+		}
+		out, d := policy.apply(segment)
+		if out == nil && isICC && icc.protect != "" {
+			out, d.Action = segment, "kept"
+			d.Reason = "non-sRGB profile " + icc.protect + " kept despite " + d.Reason + " (use -convert-to-srgb to drop it)"
+		}
+		if out != nil {
+			segments = append(segments, out)
+		}
+		decisions = append(decisions, d)
+		return true
+	})
+
+	// Create new JPEG
+	var out bytes.Buffer
+	out.Write([]byte{0xFF, 0xD8}) // SOI
+
+	// Ensure JFIF (APP0) stays first if present among segments
+	for i, seg := range segments {
+		if seg[1] == 0xE0 {
+			out.Write(seg)
+			// Remove from slices to not duplicate later
+			segments = append(segments[:i], segments[i+1:]...)
+			break
+		}
+	}
+
+	// Signature injection (APP15 segment) - EARLY in file
+	out.Write(sig.segment())
+
+	for _, seg := range segments {
+		out.Write(seg)
+	}
+
+	// Find start of image data in destination (DQT, DHT, SOF, SOS etc.)
+	imgDataIndex := -1
+	for i := 0; i < len(dstData)-1; {
+		if dstData[i] == 0xFF {
+			marker := dstData[i+1]
+			if marker == 0x00 || marker == 0xFF {
+				i++
+				continue
+			}
+			if marker == 0xD8 {
+				i += 2
+				continue
+			}
+			if !isMetadataMarker(marker) {
+				imgDataIndex = i
+				break
+			}
+			if i+3 >= len(dstData) {
+				break
+			}
+			length := int(dstData[i+2])<<8 | int(dstData[i+3])
+			i += 2 + length
+		} else {
+			i++
+		}
+	}
+
+	if imgDataIndex != -1 {
+		out.Write(dstData[imgDataIndex:])
+	} else if len(dstData) > 2 {
+		out.Write(dstData[2:]) // Fallback
+	}
+
+	return out.Bytes(), decisions
+}
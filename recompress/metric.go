@@ -0,0 +1,108 @@
+package recompress
+
+import (
+	"fmt"
+	"image"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Direction tells how a metric score compares to its threshold.
+type Direction int
+
+const (
+	// HigherIsBetter metrics are met when score >= threshold (PSNR, SSIM).
+	HigherIsBetter Direction = iota
+	// LowerIsBetter metrics are met when score <= threshold (MSE, Butteraugli).
+	LowerIsBetter
+)
+
+// Meets reports whether score satisfies threshold.
+func (d Direction) Meets(score, threshold float64) bool {
+	if d == LowerIsBetter {
+		return score <= threshold
+	}
+	return score >= threshold
+}
+
+// Metric scores a recompressed image against the original.
+type Metric interface {
+	// Name is the identifier used by Options.Metric, in lower case.
+	Name() string
+	// Compare returns the score of comp against orig. Metrics that honour
+	// sampling only look at one pixel every sample pixels in each direction.
+	// Both images have the same bounds, which do not necessarily start at
+	// (0, 0): the tiled aggregates compare tiles as sub-images.
+	Compare(orig, comp image.Image, sample int) float64
+	Direction() Direction
+	// DefaultThreshold is used when Options.Threshold is zero.
+	DefaultThreshold() float64
+	// UsesSample tells whether Compare honours the sample argument.
+	UsesSample() bool
+}
+
+// MemoryEstimator is implemented by metrics that know their working set.
+// MemoryPerPixel is the peak memory of one evaluation, encoded and decoded
+// images included, in bytes per pixel of the image: MemoryBudget divides
+// by it. Metrics without it count defaultMemoryPerPixel.
+type MemoryEstimator interface {
+	MemoryPerPixel() int64
+}
+
+// defaultMemoryPerPixel covers the encoder buffers and the encoded and
+// decoded images, for metrics that work on the pixels in place.
+const defaultMemoryPerPixel = 16
+
+var (
+	metricsMu sync.RWMutex
+	metrics   = map[string]Metric{}
+)
+
+// RegisterMetric makes m available by name. It panics if a metric with the
+// same name is already registered.
+func RegisterMetric(m Metric) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	name := strings.ToLower(m.Name())
+	if _, dup := metrics[name]; dup {
+		panic("recompress: metric " + name + " registered twice")
+	}
+	metrics[name] = m
+}
+
+// LookupMetric returns the registered metric called name (case-insensitive).
+func LookupMetric(name string) (Metric, error) {
+	metricsMu.RLock()
+	defer metricsMu.RUnlock()
+	if m, ok := metrics[strings.ToLower(name)]; ok {
+		return m, nil
+	}
+	return nil, fmt.Errorf("unknown metric '%s' (use %s)", name, strings.Join(metricNamesLocked(), ", "))
+}
+
+// MetricNames returns the names of the registered metrics, sorted.
+func MetricNames() []string {
+	metricsMu.RLock()
+	defer metricsMu.RUnlock()
+	return metricNamesLocked()
+}
+
+func metricNamesLocked() []string {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DefaultThreshold returns the default threshold of the named metric, or 0
+// if it is not registered.
+func DefaultThreshold(metric string) float64 {
+	m, err := LookupMetric(metric)
+	if err != nil {
+		return 0
+	}
+	return m.DefaultThreshold()
+}
@@ -0,0 +1,194 @@
+package recompress
+
+import (
+	"image"
+	"math"
+
+	"github.com/jasonmoo/go-butteraugli"
+	"golang.org/x/image/draw"
+)
+
+func init() {
+	RegisterMetric(psnrMetric{})
+	RegisterMetric(ssimMetric{})
+	RegisterMetric(ssimYCbCrMetric{})
+	RegisterMetric(msssimMetric{})
+	RegisterMetric(mseMetric{})
+	RegisterMetric(butteraugliMetric{})
+	RegisterMetric(ssimulacra2Metric{})
+}
+
+// psnrMetric is the peak signal-to-noise ratio in dB over RGB.
+type psnrMetric struct{}
+
+func (psnrMetric) Name() string              { return "psnr" }
+func (psnrMetric) Direction() Direction      { return HigherIsBetter }
+func (psnrMetric) DefaultThreshold() float64 { return 38.5 }
+func (psnrMetric) UsesSample() bool          { return true }
+func (psnrMetric) Compare(orig, comp image.Image, sample int) float64 {
+	return calculatePSNR(orig, comp, sample)
+}
+
+// ssimMetric is the structural similarity of luma, with the Gaussian
+// window of the reference implementation.
+type ssimMetric struct{}
+
+func (ssimMetric) Name() string              { return "ssim" }
+func (ssimMetric) Direction() Direction      { return HigherIsBetter }
+func (ssimMetric) DefaultThreshold() float64 { return 0.99 }
+func (ssimMetric) UsesSample() bool          { return true }
+func (ssimMetric) Compare(orig, comp image.Image, sample int) float64 {
+	return calculateSSIM(orig, comp, sample)
+}
+
+// MemoryPerPixel counts the float64 luma planes of both images and the
+// filter buffers of the bands.
+func (ssimMetric) MemoryPerPixel() int64 { return 48 }
+
+// ssimYCbCrMetric is the structural similarity of luma and chroma.
+type ssimYCbCrMetric struct{}
+
+func (ssimYCbCrMetric) Name() string              { return "ssim-ycbcr" }
+func (ssimYCbCrMetric) Direction() Direction      { return HigherIsBetter }
+func (ssimYCbCrMetric) DefaultThreshold() float64 { return 0.99 }
+func (ssimYCbCrMetric) UsesSample() bool          { return true }
+func (ssimYCbCrMetric) Compare(orig, comp image.Image, sample int) float64 {
+	return calculateSSIMYCbCr(orig, comp, sample)
+}
+
+// MemoryPerPixel counts three float64 planes for each image.
+func (ssimYCbCrMetric) MemoryPerPixel() int64 { return 96 }
+
+// msssimMetric is the multi-scale structural similarity of luma.
+type msssimMetric struct{}
+
+func (msssimMetric) Name() string              { return "ms-ssim" }
+func (msssimMetric) Direction() Direction      { return HigherIsBetter }
+func (msssimMetric) DefaultThreshold() float64 { return 0.995 }
+func (msssimMetric) UsesSample() bool          { return true }
+func (msssimMetric) Compare(orig, comp image.Image, sample int) float64 {
+	return calculateMSSSIM(orig, comp, sample)
+}
+
+// MemoryPerPixel counts the float64 luma pyramids of both images.
+func (msssimMetric) MemoryPerPixel() int64 { return 56 }
+
+// mseMetric is the mean squared error over RGB, normalised to [0,1].
+type mseMetric struct{}
+
+func (mseMetric) Name() string              { return "mse" }
+func (mseMetric) Direction() Direction      { return LowerIsBetter }
+func (mseMetric) DefaultThreshold() float64 { return 0.00005 }
+func (mseMetric) UsesSample() bool          { return true }
+func (mseMetric) Compare(orig, comp image.Image, sample int) float64 {
+	return calculateMSE(orig, comp, sample)
+}
+
+// butteraugliMetric is Google's psychovisual distance.
+type butteraugliMetric struct{}
+
+func (butteraugliMetric) Name() string              { return "butteraugli" }
+func (butteraugliMetric) Direction() Direction      { return LowerIsBetter }
+func (butteraugliMetric) DefaultThreshold() float64 { return 1.0 }
+func (butteraugliMetric) UsesSample() bool          { return false }
+func (butteraugliMetric) Compare(orig, comp image.Image, sample int) float64 {
+	return calculateButteraugli(orig, comp)
+}
+
+// MemoryPerPixel counts the linear RGB planes of both images, in float64,
+// and the intermediate planes of the library.
+func (butteraugliMetric) MemoryPerPixel() int64 { return 160 }
+
+// ssimulacra2Metric is the SSIMULACRA2 score of libjxl, from 100 for
+// identical images down: 90 is visually lossless, 80 very high quality.
+type ssimulacra2Metric struct{}
+
+func (ssimulacra2Metric) Name() string              { return "ssimulacra2" }
+func (ssimulacra2Metric) Direction() Direction      { return HigherIsBetter }
+func (ssimulacra2Metric) DefaultThreshold() float64 { return 80 }
+func (ssimulacra2Metric) UsesSample() bool          { return false }
+func (ssimulacra2Metric) Compare(orig, comp image.Image, sample int) float64 {
+	return calculateSSIMULACRA2(orig, comp)
+}
+
+// MemoryPerPixel counts the lower scales of both images, in float32: the
+// full scale is read from the images row by row.
+func (ssimulacra2Metric) MemoryPerPixel() int64 { return 32 }
+
+// sumSquaredError returns the sum over the sampled pixels of the squared
+// differences of their RGB channels, and the number of sampled pixels.
+func sumSquaredError(img1, img2 image.Image, sample int) (int64, int64) {
+	b := img1.Bounds()
+	rows := (b.Dy() + sample - 1) / sample
+	const bandSize = 16
+	sums := make([]int64, (rows+bandSize-1)/bandSize)
+	forBands(rows, bandSize, func(band, lo, hi int) {
+		var row1, row2 []uint8
+		for i := lo; i < hi; i++ {
+			y := b.Min.Y + i*sample
+			row1 = rgbRow(row1, img1, y, b.Min.X, b.Max.X, sample)
+			row2 = rgbRow(row2, img2, y, b.Min.X, b.Max.X, sample)
+			for j, v := range row1 {
+				d := int64(v) - int64(row2[j])
+				sums[band] += d * d
+			}
+		}
+	})
+	var sum int64
+	for _, s := range sums {
+		sum += s
+	}
+	return sum, int64(rows) * int64((b.Dx()+sample-1)/sample)
+}
+
+func calculatePSNR(img1, img2 image.Image, sample int) float64 {
+	sum, count := sumSquaredError(img1, img2, sample)
+	mse := float64(sum) / 3.0 / float64(count)
+	if mse == 0 {
+		return 100.0
+	}
+	return 20*math.Log10(255) - 10*math.Log10(mse)
+}
+
+func calculateMSE(img1, img2 image.Image, sample int) float64 {
+	sum, count := sumSquaredError(img1, img2, sample)
+	return float64(sum) / (3.0 * 255 * 255) / float64(count)
+}
+
+func calculateButteraugli(img1, img2 image.Image) float64 {
+	// Optimization: Butteraugli is extremely slow on large images.
+	// We downsample to a maximum of 0.5 Megapixels for analysis.
+	// This preserves perceptual patterns while being ~10-20x faster.
+	const maxPixels = 500000
+	b := img1.Bounds()
+	origPixels := b.Dx() * b.Dy()
+
+	if origPixels <= maxPixels {
+		if b.Min != (image.Point{}) {
+			// go-butteraugli reads the pixels from (0, 0): move tiles there
+			rect := image.Rect(0, 0, b.Dx(), b.Dy())
+			small1, small2 := image.NewRGBA(rect), image.NewRGBA(rect)
+			draw.Draw(small1, rect, img1, b.Min, draw.Src)
+			draw.Draw(small2, rect, img2, b.Min, draw.Src)
+			img1, img2 = small1, small2
+		}
+		dist, _ := butteraugli.CompareImages(img1, img2)
+		return dist
+	}
+
+	// Calculate scaling factor
+	scale := math.Sqrt(float64(maxPixels) / float64(origPixels))
+	newW, newH := int(float64(b.Dx())*scale), int(float64(b.Dy())*scale)
+	newRect := image.Rect(0, 0, newW, newH)
+
+	// Create downsampled images
+	small1 := image.NewRGBA(newRect)
+	small2 := image.NewRGBA(newRect)
+
+	// BiLinear is a good balance between speed and quality for perceptual analysis
+	draw.BiLinear.Scale(small1, newRect, img1, b, draw.Over, nil)
+	draw.BiLinear.Scale(small2, newRect, img2, b, draw.Over, nil)
+
+	dist, _ := butteraugli.CompareImages(small1, small2)
+	return dist
+}
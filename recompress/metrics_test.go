@@ -0,0 +1,39 @@
+package recompress
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestMSEDirection pins MSE as a maximum error: a smaller error meets the
+// threshold, and the thresholds of the former 1-MSE comparison are
+// rejected.
+func TestMSEDirection(t *testing.T) {
+	m, err := LookupMetric("mse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Direction() != LowerIsBetter {
+		t.Fatalf("mse direction %v, want LowerIsBetter", m.Direction())
+	}
+	orig := ssimFixture(64, 64)
+	near, far := m.Compare(orig, ssimDistort(orig, 2, 1), 1), m.Compare(orig, ssimDistort(orig, 32, 1), 1)
+	if got := m.Compare(orig, orig, 1); got != 0 {
+		t.Errorf("identical images: mse %g, want 0", got)
+	}
+	if !(near < far) {
+		t.Errorf("mse %g for light noise, %g for heavy noise: want it to grow", near, far)
+	}
+	threshold := m.DefaultThreshold()
+	if !m.Direction().Meets(threshold/2, threshold) || m.Direction().Meets(threshold*2, threshold) {
+		t.Errorf("Meets does not accept errors below %g only", threshold)
+	}
+
+	err = Options{Metric: "mse", Threshold: 0.99995}.Validate()
+	if err == nil || !strings.Contains(err.Error(), "lower is better") {
+		t.Errorf("former threshold 0.99995: error %v, want a lower is better error", err)
+	}
+	if err := (Options{Metric: "MSE", Threshold: 0.0001}).Validate(); err != nil {
+		t.Errorf("threshold 0.0001: %v", err)
+	}
+}
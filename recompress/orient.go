@@ -0,0 +1,142 @@
+package recompress
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"regexp"
+)
+
+const tagOrientation = 0x0112
+
+// xmpOrientationRe matches the tiff:Orientation property of XMP packets,
+// as an attribute or as an element.
+var xmpOrientationRe = regexp.MustCompile(`tiff:Orientation(\s*=\s*["']|>)[2-8]`)
+
+// findOrientation returns the Exif orientation (1 to 8) of the JPEG data,
+// or 0 if there is none, and the offset in data of its value.
+func findOrientation(data []byte) (int, int) {
+	orientation, at := 0, -1
+	walkSegments(data, func(marker byte, seg []byte) bool {
+		if marker == 0xDA {
+			return false
+		}
+		if segmentIdentifier(seg) != "Exif" || len(seg) < 4+len(exifPrefix)+8 {
+			return true
+		}
+		tiff := seg[4+len(exifPrefix):]
+		var order binary.ByteOrder = binary.BigEndian
+		if tiff[0] == 'I' {
+			order = binary.LittleEndian
+		}
+		ifd0 := int(order.Uint32(tiff[4:]))
+		if ifd0+2 > len(tiff) {
+			return false
+		}
+		n := int(order.Uint16(tiff[ifd0:]))
+		for i := 0; i < n && ifd0+2+12*i+12 <= len(tiff); i++ {
+			e := tiff[ifd0+2+12*i:]
+			if order.Uint16(e) == tagOrientation && order.Uint16(e[2:]) == 3 {
+				if v := int(order.Uint16(e[8:])); v >= 1 && v <= 8 {
+					orientation = v
+					// seg is a sub-slice of data: its offset is recovered
+					// from the capacities
+					at = cap(data) - cap(tiff) + ifd0 + 2 + 12*i + 8
+					if order == binary.ByteOrder(binary.BigEndian) {
+						at++ // The value is in the low byte
+					}
+				}
+				break
+			}
+		}
+		return false
+	})
+	return orientation, at
+}
+
+// resetOrientation returns a copy of the JPEG data whose Exif and XMP
+// orientation say the pixels are stored top-left (1).
+func resetOrientation(data []byte, at int) []byte {
+	out := append([]byte(nil), data...)
+	if at >= 0 {
+		out[at] = 1
+	}
+	walkSegments(out, func(marker byte, seg []byte) bool {
+		if marker == 0xDA {
+			return false
+		}
+		if segmentIdentifier(seg) == "XMP" {
+			for _, m := range xmpOrientationRe.FindAllIndex(seg, -1) {
+				seg[m[1]-1] = '1' // Same length: the segment stays valid
+			}
+		}
+		return true
+	})
+	return out
+}
+
+// orientImage returns img transformed for display according to the Exif
+// orientation, i.e. stored top-left. YCbCr images stay YCbCr (4:4:4).
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	// src maps a destination pixel to the source pixel, relative to b.Min
+	src := func(x, y int) (int, int) {
+		switch orientation {
+		case 2: // Mirrored horizontally
+			return w - 1 - x, y
+		case 3: // Rotated 180
+			return w - 1 - x, h - 1 - y
+		case 4: // Mirrored vertically
+			return x, h - 1 - y
+		case 5: // Transposed
+			return y, x
+		case 6: // Rotated 90 CW for display
+			return y, h - 1 - x
+		case 7: // Transversed
+			return w - 1 - y, h - 1 - x
+		default: // 8: rotated 90 CCW for display
+			return w - 1 - y, x
+		}
+	}
+
+	if ycc, ok := img.(*image.YCbCr); ok {
+		dst := image.NewYCbCr(image.Rect(0, 0, dw, dh), image.YCbCrSubsampleRatio444)
+		for y := 0; y < dh; y++ {
+			for x := 0; x < dw; x++ {
+				sx, sy := src(x, y)
+				sx, sy = sx+b.Min.X, sy+b.Min.Y
+				i := y*dst.YStride + x
+				dst.Y[i] = ycc.Y[ycc.YOffset(sx, sy)]
+				ci := ycc.COffset(sx, sy)
+				dst.Cb[i], dst.Cr[i] = ycc.Cb[ci], ycc.Cr[ci]
+			}
+		}
+		return dst
+	}
+	if gray, ok := img.(*image.Gray); ok {
+		dst := image.NewGray(image.Rect(0, 0, dw, dh))
+		for y := 0; y < dh; y++ {
+			for x := 0; x < dw; x++ {
+				sx, sy := src(x, y)
+				dst.Pix[y*dst.Stride+x] = gray.Pix[gray.PixOffset(sx+b.Min.X, sy+b.Min.Y)]
+			}
+		}
+		return dst
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := src(x, y)
+			dst.Set(x, y, color.RGBAModel.Convert(img.At(sx+b.Min.X, sy+b.Min.Y)))
+		}
+	}
+	return dst
+}
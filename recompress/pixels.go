@@ -0,0 +1,101 @@
+package recompress
+
+import (
+	"image"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// rgbRow fills dst, grown as needed, with the 8-bit RGB values of the pixels of row y
+// of img from x0 to x1 (excluded), every step pixels: those of
+// img.At(x, y).RGBA() >> 8. The backing slices of the common image types
+// are read directly.
+func rgbRow(dst []uint8, img image.Image, y, x0, x1, step int) []uint8 {
+	n := max((x1-x0+step-1)/step, 0)
+	if cap(dst) < 3*n {
+		dst = make([]uint8, 3*n)
+	}
+	dst = dst[:3*n]
+	switch m := img.(type) {
+	case *image.YCbCr:
+		if m.Rect.Min.X < 0 {
+			// Chroma offsets by shifts need non-negative coordinates
+			return genericRGBRow(dst, img, y, x0, x1, step)
+		}
+		// Luma samples per chroma sample, as a shift
+		s := 0
+		switch m.SubsampleRatio {
+		case image.YCbCrSubsampleRatio422, image.YCbCrSubsampleRatio420:
+			s = 1
+		case image.YCbCrSubsampleRatio411, image.YCbCrSubsampleRatio410:
+			s = 2
+		}
+		yi, ci := m.YOffset(x0, y)-x0, m.COffset(x0, y)-x0>>s
+		for i, x := 0, x0; x < x1; i, x = i+3, x+step {
+			// color.YCbCrToRGB, inlined
+			yy := int32(m.Y[yi+x]) * 0x10101
+			cb, cr := int32(m.Cb[ci+x>>s])-128, int32(m.Cr[ci+x>>s])-128
+			r, g, b := yy+91881*cr, yy-22554*cb-46802*cr, yy+116130*cb
+			dst[i], dst[i+1], dst[i+2] = clamp16(r), clamp16(g), clamp16(b)
+		}
+	case *image.RGBA:
+		for i, j := 0, m.PixOffset(x0, y); i < len(dst); i, j = i+3, j+4*step {
+			dst[i], dst[i+1], dst[i+2] = m.Pix[j], m.Pix[j+1], m.Pix[j+2]
+		}
+	case *image.NRGBA:
+		for i, j := 0, m.PixOffset(x0, y); i < len(dst); i, j = i+3, j+4*step {
+			// Premultiplied as by color.NRGBA.RGBA
+			a := uint32(m.Pix[j+3]) * 0x101
+			for k := range 3 {
+				dst[i+k] = uint8(uint32(m.Pix[j+k]) * 0x101 * a / 0xffff >> 8)
+			}
+		}
+	case *image.Gray:
+		for i, j := 0, m.PixOffset(x0, y); i < len(dst); i, j = i+3, j+step {
+			dst[i], dst[i+1], dst[i+2] = m.Pix[j], m.Pix[j], m.Pix[j]
+		}
+	default:
+		return genericRGBRow(dst, img, y, x0, x1, step)
+	}
+	return dst
+}
+
+// genericRGBRow is rgbRow through img.At.
+func genericRGBRow(dst []uint8, img image.Image, y, x0, x1, step int) []uint8 {
+	for i, x := 0, x0; x < x1; i, x = i+3, x+step {
+		r, g, b, _ := img.At(x, y).RGBA()
+		dst[i], dst[i+1], dst[i+2] = uint8(r>>8), uint8(g>>8), uint8(b>>8)
+	}
+	return dst
+}
+
+// clamp16 returns the 8-bit value of a 16.16 fixed point colour component,
+// clamped to [0, 255].
+func clamp16(v int32) uint8 {
+	if uint32(v)&0xff000000 == 0 {
+		return uint8(v >> 16)
+	}
+	return uint8(^(v >> 31))
+}
+
+// forBands calls fn for every band of n units (rows), bandSize units per
+// band, from as many goroutines as there are CPUs. Metrics keep one partial
+// sum per band and add them up in band order, so that their result does
+// not depend on the number of CPUs.
+func forBands(n, bandSize int, fn func(band, lo, hi int)) {
+	bands := (n + bandSize - 1) / bandSize
+	workers := min(runtime.GOMAXPROCS(0), bands)
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for band := int(next.Add(1) - 1); band < bands; band = int(next.Add(1) - 1) {
+				fn(band, band*bandSize, min((band+1)*bandSize, n))
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,223 @@
+package recompress
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// MetadataRule applies an action to the segments it matches.
+type MetadataRule struct {
+	// Segment matches a segment by identifier (Exif, XMP, ExtendedXMP,
+	// ICC_PROFILE, Photoshop, MPF, FPXR, Ducky, Adobe, JFIF...), by marker
+	// (APP1, APP13, COM, JPG3...), by both (APP2:ICC_PROFILE), or "*" for
+	// any segment. Matching is case-insensitive.
+	Segment string `json:"segment"`
+	// Action is keep, strip, max-size or scrub. scrub removes location
+	// and device identifiers from Exif and XMP segments and keeps the rest
+	// of them; other segments cannot be scrubbed and are stripped.
+	Action string `json:"action"`
+	// MaxSize is the largest segment, in bytes, that max-size keeps.
+	MaxSize int `json:"max_size,omitempty"`
+}
+
+// MetadataPolicy decides which source segments are transplanted into the
+// output. The first matching rule wins; segments matching no rule get the
+// Default action.
+type MetadataPolicy struct {
+	Name string `json:"name,omitempty"`
+	// Default is keep or strip.
+	Default string         `json:"default"`
+	Rules   []MetadataRule `json:"rules"`
+}
+
+// MetadataDecision records what a policy did with one source segment.
+type MetadataDecision struct {
+	Segment string `json:"segment"`
+	Size    int    `json:"size"`
+	// Action is kept, scrubbed or removed.
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+}
+
+// metadataPresets are the policies available by name.
+var metadataPresets = map[string]MetadataPolicy{
+	// web drops the heavy segments (Extended XMP payloads such as depth
+	// maps, Photoshop thumbnails, FlashPix) and keeps the rest.
+	"web": {Name: "web", Default: "keep", Rules: []MetadataRule{
+		{Segment: "ExtendedXMP", Action: "strip"},
+		{Segment: "Photoshop", Action: "strip"},
+		{Segment: "FPXR", Action: "strip"},
+	}},
+	// archive keeps every segment.
+	"archive": {Name: "archive", Default: "keep"},
+	// privacy keeps what rendering needs, and Exif and XMP without
+	// location and device identifiers. As it scrubs, trailers are stripped
+	// (see scrubs).
+	"privacy": {Name: "privacy", Default: "strip", Rules: []MetadataRule{
+		{Segment: "JFIF", Action: "keep"},
+		{Segment: "ICC_PROFILE", Action: "keep"},
+		{Segment: "Adobe", Action: "keep"},
+		{Segment: "Exif", Action: "scrub"},
+		{Segment: "XMP", Action: "scrub"},
+	}},
+	// none strips every segment.
+	"none": {Name: "none", Default: "strip"},
+}
+
+// MetadataPresets returns the names of the built-in policies, sorted.
+func MetadataPresets() []string {
+	names := make([]string, 0, len(metadataPresets))
+	for name := range metadataPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadMetadataPolicy returns the built-in policy called nameOrPath, or
+// reads a JSON policy from the file at that path.
+func LoadMetadataPolicy(nameOrPath string) (*MetadataPolicy, error) {
+	if p, ok := metadataPresets[strings.ToLower(nameOrPath)]; ok {
+		return &p, nil
+	}
+	data, err := os.ReadFile(nameOrPath)
+	if err != nil {
+		return nil, fmt.Errorf("metadata policy '%s' is neither a preset (%s) nor a readable file: %v",
+			nameOrPath, strings.Join(MetadataPresets(), ", "), err)
+	}
+	p := &MetadataPolicy{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("metadata policy %s: %v", nameOrPath, err)
+	}
+	if p.Name == "" {
+		p.Name = nameOrPath
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Validate reports unknown actions and incomplete rules.
+func (p *MetadataPolicy) Validate() error {
+	if p.Default != "keep" && p.Default != "strip" {
+		return fmt.Errorf("metadata policy %s: invalid default action '%s' (use keep or strip)", p.Name, p.Default)
+	}
+	for _, r := range p.Rules {
+		if r.Segment == "" {
+			return fmt.Errorf("metadata policy %s: rule without segment", p.Name)
+		}
+		switch r.Action {
+		case "keep", "strip", "scrub":
+		case "max-size":
+			if r.MaxSize <= 0 {
+				return fmt.Errorf("metadata policy %s: max-size rule for %s needs a positive max_size", p.Name, r.Segment)
+			}
+		default:
+			return fmt.Errorf("metadata policy %s: invalid action '%s' for %s (use keep, strip, max-size or scrub)", p.Name, r.Action, r.Segment)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the rule applies to seg, named name (APPn:Id).
+func (r MetadataRule) matches(seg []byte, name string) bool {
+	want := strings.ToLower(r.Segment)
+	if want == "*" {
+		return true
+	}
+	marker, id, _ := strings.Cut(strings.ToLower(name), ":")
+	if want == marker || want == id || want == strings.ToLower(name) {
+		return true
+	}
+	// Also accept the raw identifier, e.g. "Photoshop 3.0"
+	for _, known := range appIdentifiers {
+		if strings.ToLower(known.name) == id && strings.ToLower(strings.TrimRight(known.prefix, "\x00")) == want {
+			return true
+		}
+	}
+	return false
+}
+
+// scrubbers rewrite the segments, by identifier, that scrub applies to.
+var scrubbers = map[string]func(seg []byte) ([]byte, []string, error){
+	"Exif": scrubExif,
+	"XMP":  scrubXMP,
+}
+
+// scrubs tells whether p has scrub rules. Such a policy strips kept
+// trailers: Motion Photo videos and MPF secondary images carry their own
+// Exif and location data, which cannot be scrubbed.
+func (p *MetadataPolicy) scrubs() bool {
+	for _, r := range p.Rules {
+		if r.Action == "scrub" {
+			return true
+		}
+	}
+	return false
+}
+
+// apply returns the segment policy p puts in the output in place of seg
+// (nil if it is removed), and the decision taken.
+func (p *MetadataPolicy) apply(seg []byte) ([]byte, MetadataDecision) {
+	name := segmentName(seg)
+	d := MetadataDecision{Segment: name, Size: len(seg)}
+	action, reason := p.Default, "default of policy "+p.Name
+	for _, r := range p.Rules {
+		if !r.matches(seg, name) {
+			continue
+		}
+		action, reason = r.Action, "rule "+r.Segment+": "+r.Action
+		if r.Action == "max-size" {
+			if len(seg) <= r.MaxSize {
+				action = "keep"
+				reason = fmt.Sprintf("rule %s: within max-size %d", r.Segment, r.MaxSize)
+			} else {
+				action = "strip"
+				reason = fmt.Sprintf("rule %s: larger than max-size %d", r.Segment, r.MaxSize)
+			}
+		}
+		break
+	}
+	d.Reason = reason
+	switch action {
+	case "keep":
+		d.Action = "kept"
+		return seg, d
+	case "scrub":
+		scrub, ok := scrubbers[segmentIdentifier(seg)]
+		if !ok {
+			d.Action, d.Reason = "removed", reason+" (cannot be scrubbed)"
+			return nil, d
+		}
+		out, removed, err := scrub(seg)
+		if err != nil {
+			d.Action, d.Reason = "removed", fmt.Sprintf("%s (unreadable: %v)", reason, err)
+			return nil, d
+		}
+		if len(removed) == 0 {
+			d.Action, d.Reason = "kept", reason+" (nothing to remove)"
+			return seg, d
+		}
+		d.Action, d.Reason = "scrubbed", reason+" (removed "+strings.Join(uniqueStrings(removed), ", ")+")"
+		return out, d
+	}
+	d.Action = "removed"
+	return nil, d
+}
+
+// uniqueStrings returns s without duplicates, in order of first occurrence.
+func uniqueStrings(s []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, v := range s {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,82 @@
+package recompress
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+)
+
+// TestPrivacyStripsTrailer checks that the privacy policy does not leak
+// the location through a trailer: the secondary JPEG after the primary
+// image carries its own GPS data, which cannot be scrubbed.
+func TestPrivacyStripsTrailer(t *testing.T) {
+	primary := withSegment(testJPEG(t, 128, 96, 98), testExif(binary.BigEndian, "PRIMARY-DATUM", nil))
+	secondary := withSegment(testJPEG(t, 32, 24, 90), testExif(binary.BigEndian, "TRAILER-DATUM", nil))
+	src := append(append([]byte(nil), primary...), secondary...)
+
+	for _, tt := range []struct {
+		policy      string
+		keepTrailer bool
+	}{
+		{"privacy", false},
+		{"web", true},
+	} {
+		policy, err := LoadMetadataPolicy(tt.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		res, err := Recompress(context.Background(), bytes.NewReader(src), &out, Options{Quality: 50, MetadataPolicy: policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Skipped || res.Copied {
+			t.Fatalf("%s: source kept (%s)", tt.policy, res.Reason)
+		}
+		_, trailer := splitTrailer(out.Bytes())
+		if got := trailer != nil; got != tt.keepTrailer {
+			t.Errorf("%s: trailer kept %v, want %v", tt.policy, got, tt.keepTrailer)
+		}
+		if tt.keepTrailer {
+			continue
+		}
+		for _, datum := range []string{"PRIMARY-DATUM", "TRAILER-DATUM"} {
+			if bytes.Contains(out.Bytes(), []byte(datum)) {
+				t.Errorf("%s: output still holds the GPS data %s", tt.policy, datum)
+			}
+		}
+		found := false
+		for _, d := range res.Metadata {
+			found = found || d.Segment == "trailer" && d.Action == "removed"
+		}
+		if !found {
+			t.Errorf("%s: no decision reports the trailer removed: %+v", tt.policy, res.Metadata)
+		}
+	}
+}
+
+// TestCopiedSourceMetadata checks that a source kept as it is reports no
+// metadata decisions: those of the rejected lossy and lossless outputs
+// describe files that were never written.
+func TestCopiedSourceMetadata(t *testing.T) {
+	src := withSegment(testJPEG(t, 128, 96, 90), testExif(binary.BigEndian, "PRIMARY-DATUM", nil))
+	policy, err := LoadMetadataPolicy("privacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	res, err := Recompress(context.Background(), bytes.NewReader(src), &out, Options{MinGainPercent: 99, MetadataPolicy: policy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Copied {
+		t.Fatalf("source not copied: %+v", res)
+	}
+	if !bytes.Equal(out.Bytes(), src) {
+		t.Error("copied output differs from the source")
+	}
+	if len(res.Metadata) != 0 || len(res.DroppedSegments) != 0 {
+		t.Errorf("copied source reports metadata decisions %+v, dropped %v", res.Metadata, res.DroppedSegments)
+	}
+}
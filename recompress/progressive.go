@@ -0,0 +1,268 @@
+package recompress
+
+import (
+	"bytes"
+	"errors"
+	"math/bits"
+)
+
+// progressiveScan is one scan of a progressive scan script: the components
+// it codes (by index), its spectral selection and its successive
+// approximation bit positions.
+type progressiveScan struct {
+	comps  []int
+	ss, se int
+	ah, al uint
+}
+
+// progressiveScript returns the scan script of libjpeg's
+// jpeg_simple_progression for n components (1 or 3): DC first, a coarse
+// pass over the luma AC coefficients and the chroma, then refinements.
+func progressiveScript(n int) []progressiveScan {
+	if n == 1 {
+		return []progressiveScan{
+			{[]int{0}, 0, 0, 0, 1},
+			{[]int{0}, 1, 5, 0, 2},
+			{[]int{0}, 6, 63, 0, 2},
+			{[]int{0}, 1, 63, 2, 1},
+			{[]int{0}, 0, 0, 1, 0},
+			{[]int{0}, 1, 63, 1, 0},
+		}
+	}
+	return []progressiveScan{
+		{[]int{0, 1, 2}, 0, 0, 0, 1},
+		{[]int{0}, 1, 5, 0, 2},
+		{[]int{2}, 1, 63, 0, 1},
+		{[]int{1}, 1, 63, 0, 1},
+		{[]int{0}, 6, 63, 0, 2},
+		{[]int{0}, 1, 63, 2, 1},
+		{[]int{0, 1, 2}, 0, 0, 1, 0},
+		{[]int{2}, 1, 63, 1, 0},
+		{[]int{1}, 1, 63, 1, 0},
+		{[]int{0}, 1, 63, 1, 0},
+	}
+}
+
+// progressiveJPEG rewrites the JPEG data as a progressive JPEG with the
+// same coefficients, like jpegtran -progressive. The result holds no
+// metadata.
+func progressiveJPEG(data []byte) ([]byte, error) {
+	coefs, err := decodeCoefficients(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(coefs.comps) != 1 && len(coefs.comps) != 3 {
+		return nil, errors.New("progressive: only grayscale and YCbCr JPEGs are supported")
+	}
+	return coefs.encodeProgressive(), nil
+}
+
+// scanCoder receives the Huffman symbols and the raw bits of a scan: the
+// first pass counts the symbol frequencies, the second writes the codes
+// of the optimal tables built from them.
+type scanCoder struct {
+	table func(i int) int // Huffman table of component i
+	sym   func(t int, s byte)
+	raw   func(v uint32, n uint)
+}
+
+// encodeProgressive writes the coefficients as a progressive JPEG (SOF2)
+// with the script of progressiveScript and optimal Huffman tables for
+// every scan.
+func (j *jpegCoefs) encodeProgressive() []byte {
+	var out bytes.Buffer
+	j.writeFrame(&out, 0xC2)
+
+	for _, sc := range progressiveScript(len(j.comps)) {
+		// DC scans use tables 0 for the luma, tables 1 for the chroma;
+		// AC scans code a single component with table 0
+		table := func(i int) int { return 0 }
+		if sc.ss == 0 {
+			table = func(i int) int { return min(i, 1) }
+		}
+		class := 0
+		if sc.ss > 0 {
+			class = 1
+		}
+
+		var freq [2][256]int64
+		used := [2]bool{}
+		if sc.ss > 0 || sc.ah == 0 {
+			j.codeScan(sc, scanCoder{table: table,
+				sym: func(t int, s byte) { freq[t][s]++; used[t] = true },
+				raw: func(uint32, uint) {}})
+		}
+		var tables [2]*huffTable
+		var dht []byte
+		for t := range tables {
+			if used[t] {
+				tables[t] = optimalHuffTable(&freq[t])
+				dht = append(dht, dhtTable(class, t, tables[t])...)
+			}
+		}
+		if dht != nil {
+			writeSegment(&out, 0xC4, dht)
+		}
+
+		sos := []byte{byte(len(sc.comps))}
+		for _, i := range sc.comps {
+			t := byte(table(i))
+			sos = append(sos, j.comps[i].id, t<<4|t)
+		}
+		writeSegment(&out, 0xDA, append(sos, byte(sc.ss), byte(sc.se), byte(sc.ah<<4|sc.al)))
+
+		w := &bitWriter{buf: &out}
+		j.codeScan(sc, scanCoder{table: table,
+			sym: func(t int, s byte) { w.write(uint32(tables[t].code[s]), uint(tables[t].size[s])) },
+			raw: w.write})
+		w.flush()
+	}
+	out.Write([]byte{0xFF, 0xD9})
+	return out.Bytes()
+}
+
+// codeScan runs the encoding procedure of a progressive scan (JPEG Annex
+// G.1.2) through c.
+func (j *jpegCoefs) codeScan(sc progressiveScan, c scanCoder) {
+	switch {
+	case sc.ss == 0 && sc.ah == 0:
+		// DC first: differences of the point transformed DC values
+		preds := make([]int32, len(j.comps))
+		j.eachBlock(sc.comps, func(i int, blk []int16) {
+			v := int32(blk[0]) >> sc.al
+			s, bits := magnitude(v - preds[i])
+			c.sym(c.table(i), byte(s))
+			c.raw(bits, s)
+			preds[i] = v
+		})
+	case sc.ss == 0:
+		// DC refinement: one bit per block
+		j.eachBlock(sc.comps, func(i int, blk []int16) {
+			c.raw(uint32(blk[0]>>sc.al)&1, 1)
+		})
+	case sc.ah == 0:
+		j.codeACFirst(sc, c)
+	default:
+		j.codeACRefine(sc, c)
+	}
+}
+
+// emitEOBRun codes a run of n end of blocks, if any.
+func emitEOBRun(c scanCoder, n int) {
+	if n == 0 {
+		return
+	}
+	nbits := uint(bits.Len(uint(n)) - 1)
+	c.sym(0, byte(nbits<<4))
+	c.raw(uint32(n), nbits)
+}
+
+// codeACFirst codes the first pass over a spectral band (G.1.2.2).
+func (j *jpegCoefs) codeACFirst(sc progressiveScan, c scanCoder) {
+	eobrun := 0
+	j.eachBlock(sc.comps, func(_ int, blk []int16) {
+		run := 0
+		for k := sc.ss; k <= sc.se; k++ {
+			v := int32(blk[k])
+			if v < 0 {
+				v = -(-v >> sc.al)
+			} else {
+				v >>= sc.al
+			}
+			if v == 0 {
+				run++
+				continue
+			}
+			emitEOBRun(c, eobrun)
+			eobrun = 0
+			for run > 15 {
+				c.sym(0, 0xF0)
+				run -= 16
+			}
+			s, bits := magnitude(v)
+			c.sym(0, byte(run<<4)|byte(s))
+			c.raw(bits, s)
+			run = 0
+		}
+		if run > 0 {
+			if eobrun++; eobrun == 0x7FFF {
+				emitEOBRun(c, eobrun)
+				eobrun = 0
+			}
+		}
+	})
+	emitEOBRun(c, eobrun)
+}
+
+// codeACRefine codes a successive approximation refinement of a spectral
+// band (G.1.2.3), as libjpeg's encode_mcu_AC_refine: the correction bits
+// of coefficients already non-zero follow the next symbol, or the end of
+// block run they belong to.
+func (j *jpegCoefs) codeACRefine(sc progressiveScan, c scanCoder) {
+	eobrun := 0
+	var pending []byte // Correction bits of the blocks of the EOB run
+	flushEOB := func() {
+		emitEOBRun(c, eobrun)
+		for _, b := range pending {
+			c.raw(uint32(b), 1)
+		}
+		eobrun, pending = 0, pending[:0]
+	}
+	var abs [64]int32
+	var corr []byte
+	j.eachBlock(sc.comps, func(_ int, blk []int16) {
+		// eob is the last coefficient that becomes non-zero in this scan
+		eob := 0
+		for k := sc.ss; k <= sc.se; k++ {
+			v := int32(blk[k])
+			if v < 0 {
+				v = -v
+			}
+			abs[k] = v >> sc.al
+			if abs[k] == 1 {
+				eob = k
+			}
+		}
+		run := 0
+		corr = corr[:0]
+		for k := sc.ss; k <= sc.se; k++ {
+			if abs[k] == 0 {
+				run++
+				continue
+			}
+			for run > 15 && k <= eob {
+				flushEOB()
+				c.sym(0, 0xF0)
+				run -= 16
+				for _, b := range corr {
+					c.raw(uint32(b), 1)
+				}
+				corr = corr[:0]
+			}
+			if abs[k] > 1 {
+				corr = append(corr, byte(abs[k]&1))
+				continue
+			}
+			flushEOB()
+			c.sym(0, byte(run<<4|1))
+			sign := uint32(1)
+			if blk[k] < 0 {
+				sign = 0
+			}
+			c.raw(sign, 1)
+			for _, b := range corr {
+				c.raw(uint32(b), 1)
+			}
+			corr = corr[:0]
+			run = 0
+		}
+		if run > 0 || len(corr) > 0 {
+			eobrun++
+			pending = append(pending, corr...)
+			if eobrun == 0x7FFF || len(pending) > 937 {
+				flushEOB()
+			}
+		}
+	})
+	flushEOB()
+}
@@ -0,0 +1,147 @@
+package recompress
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"slices"
+	"testing"
+)
+
+// flatJPEG encodes a w x h image of the single colour c with image/jpeg:
+// all its AC coefficients are zero.
+func flatJPEG(t *testing.T, w, h int, c color.Color) []byte {
+	t.Helper()
+	var img draw.Image = image.NewRGBA(image.Rect(0, 0, w, h))
+	if _, ok := c.(color.Gray); ok {
+		img = image.NewGray(image.Rect(0, 0, w, h))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withCorrections sets the AC coefficients of the blocks of j to ±2 or
+// ±3, which the last refinement scan codes as correction bits only, so
+// that they pile up in end of block runs. One block out of 32 instead has
+// a 3, 19 zeros and a -1: a ZRL after a correction bit. The padding blocks
+// of the components, which AC scans do not code, are left alone.
+func withCorrections(j *jpegCoefs) {
+	for _, c := range j.comps {
+		b := 0
+		for by := 0; by < c.ch; by++ {
+			for bx := 0; bx < c.cw; bx++ {
+				blk := c.block(bx, by)
+				for k := 1; k < 64; k++ {
+					blk[k] = int16(2 + (b+k)%2)
+					if k%3 == 0 {
+						blk[k] = -blk[k]
+					}
+				}
+				if b%32 == 0 {
+					blk[1] = 3
+					clear(blk[2:21])
+					blk[21] = -1
+				}
+				b++
+			}
+		}
+	}
+}
+
+// TestProgressiveRoundTrip checks that the progressive encoding of
+// coefficients decodes, with decodeCoefficients, to the same coefficients
+// (those of the padding blocks of the MCUs aside, which AC scans do not
+// code) and, with image/jpeg, to the pixels of their baseline encoding.
+// The flat images have more blocks than an end of block run can hold.
+func TestProgressiveRoundTrip(t *testing.T) {
+	coefs := func(data []byte) *jpegCoefs {
+		j, err := decodeCoefficients(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return j
+	}
+	corrections := func(j *jpegCoefs) *jpegCoefs {
+		withCorrections(j)
+		return j
+	}
+	tests := []struct {
+		name  string
+		coefs *jpegCoefs
+	}{
+		{"grayscale", coefs(testGrayJPEG(t, 100, 75, 85))},
+		{"4:2:0", coefs(testJPEG(t, 100, 75, 85))},
+		{"4:4:4", encodeYCbCr(jpegPixels(t, testJPEG(t, 100, 75, 85)), 100, image.YCbCrSubsampleRatio444)},
+		{"grayscale corrections", corrections(coefs(testGrayJPEG(t, 100, 75, 85)))},
+		{"4:2:0 corrections", corrections(coefs(testJPEG(t, 100, 75, 85)))},
+		{"flat grayscale", coefs(flatJPEG(t, 1600, 1600, color.Gray{90}))},
+		{"flat 4:2:0", coefs(flatJPEG(t, 1456, 1456, color.RGBA{200, 120, 40, 255}))},
+	}
+	for _, tt := range tests {
+		out := tt.coefs.encodeProgressive()
+		got := coefs(out)
+		if !got.progressive {
+			t.Errorf("%s: not progressive", tt.name)
+		}
+		for i, c := range tt.coefs.comps {
+			for by := 0; by < c.ch; by++ {
+				for bx := 0; bx < c.cw; bx++ {
+					if !slices.Equal(got.comps[i].block(bx, by), c.block(bx, by)) {
+						t.Fatalf("%s: coefficients of component %d, block (%d, %d) differ", tt.name, i, bx, by)
+					}
+				}
+			}
+		}
+		if got, want := jpegPixels(t, out), jpegPixels(t, tt.coefs.encodeBaseline()); !bytes.Equal(got.Pix, want.Pix) {
+			t.Errorf("%s: pixels differ from the baseline encoding", tt.name)
+		}
+	}
+}
+
+// TestACRefineCorrectionLimit checks that an end of block run of a
+// refinement scan never carries more correction bits than libjpeg's
+// decoder buffers (1000): codeACRefine flushes it once it holds more than
+// 937, as libjpeg's encoder.
+func TestACRefineCorrectionLimit(t *testing.T) {
+	j, err := decodeCoefficients(testGrayJPEG(t, 100, 75, 85))
+	if err != nil {
+		t.Fatal(err)
+	}
+	withCorrections(j)
+	// The correction bits of a run follow its EOBn symbol and the n bits
+	// of its length
+	longest, bits, inRun, length := 0, 0, false, false
+	j.codeACRefine(progressiveScan{[]int{0}, 1, 63, 1, 0}, scanCoder{
+		table: func(int) int { return 0 },
+		sym: func(_ int, s byte) {
+			longest, bits = max(longest, bits), 0
+			inRun = s&0x0F == 0 && s != 0xF0
+			length = inRun
+		},
+		raw: func(uint32, uint) {
+			switch {
+			case length:
+				length = false
+			case inRun:
+				bits++
+			}
+		},
+	})
+	longest = max(longest, bits)
+	if longest > 1000 {
+		t.Errorf("an end of block run carries %d correction bits, more than 1000", longest)
+	}
+	if longest <= 937 {
+		t.Errorf("the longest end of block run carries %d correction bits: the limit is not reached", longest)
+	}
+}
@@ -0,0 +1,137 @@
+package recompress
+
+// ijgQuant are the Annex K quantization tables (luminance, chrominance) in
+// zig-zag order, as scaled by libjpeg and image/jpeg for quality 50.
+var ijgQuant = [2][64]int{
+	{
+		16, 11, 12, 14, 12, 10, 16, 14,
+		13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37,
+		29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68,
+		87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113,
+		121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	{
+		17, 18, 18, 24, 21, 24, 47, 26,
+		26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// parseDQT returns the quantization tables defined before the first scan,
+// by table id, in zig-zag order.
+func parseDQT(data []byte) map[int][64]int {
+	tables := map[int][64]int{}
+	for i := 0; i < len(data)-1; {
+		if data[i] != 0xFF {
+			i++
+			continue
+		}
+		marker := data[i+1]
+		if marker == 0x00 || marker == 0xFF {
+			i++
+			continue
+		}
+		if marker == 0xD8 {
+			i += 2
+			continue
+		}
+		if marker == 0xDA { // Start of scan
+			break
+		}
+		if i+3 >= len(data) {
+			break
+		}
+		length := int(data[i+2])<<8 | int(data[i+3])
+		if marker == 0xDB && i+2+length <= len(data) {
+			// A DQT segment holds one or more tables: Pq/Tq then 64 values
+			// of 8 (Pq=0) or 16 (Pq=1) bits.
+			seg := data[i+4 : i+2+length]
+			for len(seg) > 0 {
+				precision, id := seg[0]>>4, int(seg[0]&0x0F)
+				size := 64
+				if precision == 1 {
+					size = 128
+				}
+				if len(seg) < 1+size {
+					break
+				}
+				var t [64]int
+				for k := range t {
+					if precision == 1 {
+						t[k] = int(seg[1+2*k])<<8 | int(seg[2+2*k])
+					} else {
+						t[k] = int(seg[1+k])
+					}
+				}
+				tables[id] = t
+				seg = seg[1+size:]
+			}
+		}
+		i += 2 + length
+	}
+	return tables
+}
+
+// ijgTable returns the table base scaled for quality the way libjpeg does.
+func ijgTable(base [64]int, quality int) [64]int {
+	scale := 200 - 2*quality
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	var t [64]int
+	for k, v := range base {
+		x := (v*scale + 50) / 100
+		if x < 1 {
+			x = 1
+		} else if x > 255 {
+			x = 255
+		}
+		t[k] = x
+	}
+	return t
+}
+
+// estimateQuality returns the IJG quality (1-100) whose standard tables are
+// closest to the quantization tables of the JPEG data, or 0 when the data
+// has no usable table. Files written by libjpeg or image/jpeg give their
+// exact quality back; other encoders get the nearest equivalent.
+func estimateQuality(data []byte) int {
+	tables := parseDQT(data)
+	luma, ok := tables[0]
+	if !ok {
+		return 0
+	}
+	chroma, hasChroma := tables[1]
+
+	best, bestErr := 0, -1
+	for q := 1; q <= 100; q++ {
+		diff := 0
+		for k, v := range ijgTable(ijgQuant[0], q) {
+			diff += abs(luma[k] - v)
+		}
+		if hasChroma {
+			for k, v := range ijgTable(ijgQuant[1], q) {
+				diff += abs(chroma[k] - v)
+			}
+		}
+		if bestErr < 0 || diff < bestErr {
+			best, bestErr = q, diff
+		}
+	}
+	return best
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,92 @@
+package recompress
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+// TestEstimateQuality checks that the quality of JPEGs written by
+// image/jpeg, in colour and in grey, and by encodeYCbCr comes back exactly,
+// at every quality.
+func TestEstimateQuality(t *testing.T) {
+	src := jpegPixels(t, testJPEG(t, 32, 32, 90))
+	for q := 1; q <= 100; q++ {
+		for _, tt := range []struct {
+			name string
+			data []byte
+		}{
+			{"image/jpeg", testJPEG(t, 32, 32, q)},
+			{"image/jpeg grey", testGrayJPEG(t, 32, 32, q)},
+			{"encodeYCbCr", encodeYCbCr(src, q, image.YCbCrSubsampleRatio420).encodeBaseline()},
+		} {
+			if got := estimateQuality(tt.data); got != q {
+				t.Errorf("%s quality %d: estimated %d", tt.name, q, got)
+			}
+		}
+	}
+}
+
+// dqtSegment returns a DQT segment holding tables, by id, of precision 1
+// (16-bit values) for the ids in wide and 0 for the others.
+func dqtSegment(tables map[int][64]int, ids []int, wide map[int]bool) []byte {
+	var p []byte
+	for _, id := range ids {
+		if !wide[id] {
+			p = append(p, byte(id))
+			for _, v := range tables[id] {
+				p = append(p, byte(v))
+			}
+			continue
+		}
+		p = append(p, 1<<4|byte(id))
+		for _, v := range tables[id] {
+			p = append(p, byte(v>>8), byte(v))
+		}
+	}
+	return append([]byte{0xFF, 0xDB, byte((len(p) + 2) >> 8), byte(len(p) + 2)}, p...)
+}
+
+// TestParseDQT checks the parsing of 8-bit and 16-bit tables, held by one
+// DQT segment or several, and that tables after the first scan are ignored.
+func TestParseDQT(t *testing.T) {
+	var wide [64]int
+	for k := range wide {
+		wide[k] = 100 + 300*k // Up to 18 998: needs 16 bits
+	}
+	tables := map[int][64]int{
+		0: ijgTable(ijgQuant[0], 75),
+		1: ijgTable(ijgQuant[1], 75),
+		2: wide,
+		3: ijgTable(ijgQuant[0], 30),
+	}
+	soi, sos, eoi := []byte{0xFF, 0xD8}, []byte{0xFF, 0xDA, 0, 2}, []byte{0xFF, 0xD9}
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	tests := []struct {
+		name string
+		data []byte
+		want []int // Table ids
+	}{
+		{"one segment", join(soi, dqtSegment(tables, []int{0, 1, 2, 3}, map[int]bool{2: true}), eoi), []int{0, 1, 2, 3}},
+		{"all 16-bit", join(soi, dqtSegment(tables, []int{0, 1, 2, 3}, map[int]bool{0: true, 1: true, 2: true, 3: true}), eoi), []int{0, 1, 2, 3}},
+		{"several segments", join(soi, dqtSegment(tables, []int{2}, map[int]bool{2: true}), dqtSegment(tables, []int{0, 1}, nil), eoi), []int{0, 1, 2}},
+		{"after the scan", join(soi, dqtSegment(tables, []int{0}, nil), sos, dqtSegment(tables, []int{3}, nil), eoi), []int{0}},
+	}
+	for _, tt := range tests {
+		got := parseDQT(tt.data)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: %d tables, want %d", tt.name, len(got), len(tt.want))
+		}
+		for _, id := range tt.want {
+			if got[id] != tables[id] {
+				t.Errorf("%s: table %d is %v, want %v", tt.name, id, got[id], tables[id])
+			}
+		}
+	}
+
+	// The quality of IJG tables does not depend on their precision
+	data := join(soi, dqtSegment(tables, []int{0, 1}, map[int]bool{0: true, 1: true}), eoi)
+	if got := estimateQuality(data); got != 75 {
+		t.Errorf("16-bit tables of quality 75: estimated %d", got)
+	}
+}
@@ -0,0 +1,843 @@
+// Package recompress finds the lowest JPEG quality that keeps an image above
+// a visual quality threshold, and rebuilds the file with its original
+// metadata. It is the engine behind the jpeg-recompress.go and
+// jpegli-encode.go command-line tools.
+package recompress
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/png"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Signature is written in a private APP15 segment of every file produced
+// with the default Options, and used to detect already processed files.
+const Signature = "jpeg-recompress.go"
+
+// Options configures a recompression. The zero value is usable and matches
+// the defaults of the jpeg-recompress.go command.
+type Options struct {
+	// Metric is the name of a registered Metric, psnr by default.
+	Metric string
+	// Threshold is the score the output must reach, in the direction of
+	// the metric. Zero selects the metric default threshold.
+	Threshold float64
+	// MinQuality and MaxQuality bound the quality search (default 70 and
+	// 90, each defaulted on its own).
+	MinQuality int
+	MaxQuality int
+	// Quality, when set, encodes once at this quality without searching
+	// and without computing the final metrics.
+	Quality int
+	// ChromaSubsampling is 444, 422 or 420, for encoders that support it,
+	// or auto. In the threshold search, auto runs the joint search and keeps
+	// the subsampling giving the smallest output. With a fixed Quality or a
+	// target size there is no threshold to search against, and auto falls
+	// back to a heuristic on the chroma detail of the image: 4:2:0 unless
+	// subsampling would blur chroma edges, as in screenshots, coloured text
+	// or line art. Empty uses the encoder default (4:2:0 for std, 4:4:4 for
+	// jpegli).
+	ChromaSubsampling string
+	// Progressive writes progressive JPEGs, with encoders that support it.
+	// The search measures the progressive output, and the lossless
+	// optimization also produces a progressive file.
+	Progressive bool
+	// MetadataPolicy decides which source segments are kept, the web
+	// preset by default (see LoadMetadataPolicy).
+	MetadataPolicy *MetadataPolicy
+	// KeepAllMetadata is a shorthand for the archive preset, which keeps
+	// every non-image segment.
+	KeepAllMetadata bool
+	// SkipMetadata is a shorthand for the none preset, which drops every
+	// segment except the signature.
+	SkipMetadata bool
+	// Encoder is the name of a registered Encoder, std (image/jpeg) by
+	// default.
+	Encoder string
+	// Sample is the pixel sub-sampling step used by the metrics (0=auto).
+	Sample int
+	// MetricAggregate tells what part of the image the threshold applies
+	// to: the whole image (mean, the default), or tiles of about TileSize
+	// pixels a side (256 by default), scored one by one. min-tile gates on
+	// the worst tile, p5-tile on the 5th percentile of the tiles, so that
+	// artefacts in one area cannot be averaged away by a large clean one.
+	MetricAggregate string
+	TileSize        int
+	// AllScores scores the output with every registered metric. By default
+	// only Metric and the metrics of the legacy fields of the JSON output
+	// (psnr, ssim, mse, butteraugli) are, each a full pass over the image.
+	AllScores bool
+	// Fast searches with a step of 2 instead of 1.
+	Fast bool
+	// Threads is the number of qualities the search evaluates concurrently
+	// (1 by default). It does not change the chosen quality.
+	Threads int
+	// MemoryBudget, when set, caps the concurrent evaluations to those
+	// that fit in this many bytes, as estimated from the image size and the
+	// metric (see MemoryEstimator).
+	MemoryBudget int64
+	// Search is the search strategy: quality (default) searches the
+	// quality alone, joint searches it for each chroma subsampling (4:4:4,
+	// 4:2:2, 4:2:0) in parallel and keeps the smallest output meeting the
+	// threshold. Joint applies to colour images and encoders that support
+	// chroma subsampling, and excludes ChromaSubsampling, Quality and
+	// target size mode.
+	Search string
+	// TargetSize, when set, switches to target size mode: the search picks
+	// the highest quality whose final file (metadata included) fits in
+	// TargetSize bytes. In this mode a non-zero Threshold is a floor the
+	// output must still meet, and zero disables the metric check. A kept
+	// trailer (see Trailer) is not counted.
+	TargetSize int64
+	// TargetRatio is a target size given as a fraction of the source size
+	// (e.g. 0.6), trailer excluded. When both are set, the smaller budget
+	// wins.
+	TargetRatio float64
+	// IgnoreSourceQuality lets the search go above the quality estimated
+	// from the source quantization tables. By default MaxQuality is clamped
+	// to it, and a source below MinQuality is skipped.
+	IgnoreSourceQuality bool
+	// Trailer tells what to do with data found after the end of the primary
+	// image (Motion Photo video, MPF secondary images): keep (default)
+	// appends it back and fixes the MPF offsets, strip drops it along with
+	// the MPF segment, skip-file leaves such files untouched. Metadata
+	// policies that scrub (privacy) strip a kept trailer, whose own
+	// metadata they cannot scrub.
+	Trailer string
+	// AutoOrient applies the Exif orientation to the pixels before the
+	// search, and sets the orientation of the output metadata to 1
+	// (top-left), so that the output displays right even without Exif.
+	AutoOrient bool
+	// ConvertToSRGB converts the pixels of images with a non-sRGB
+	// matrix/TRC ICC profile (Display P3, Adobe RGB...) to sRGB, and
+	// replaces the profile according to SRGBProfile: embed (default) a
+	// compact sRGB profile, or none. Without it, a non-sRGB profile is
+	// never stripped by the metadata policy.
+	ConvertToSRGB bool
+	SRGBProfile   string
+	// Lossless only rewrites the Huffman coding of the source JPEG, with
+	// optimal tables, instead of searching for a quality: the output
+	// decodes to the same pixels. Otherwise this lossless optimization is
+	// tried when the lossy search gains nothing, unless NoLosslessFallback
+	// is set.
+	Lossless           bool
+	NoLosslessFallback bool
+	// MinGainPercent and MinGainBytes are the minimum savings for the
+	// output to be used. A smaller gain is handled like no gain at all.
+	MinGainPercent float64
+	MinGainBytes   int64
+	// Signature overrides the APP15 signature, Signature by default.
+	Signature string
+	// Force processes files that already carry a signature.
+	Force bool
+	// ReprocessIf lists conditions (see ReprocessConditions) under which a
+	// file that already carries a signature is processed again, based on
+	// the parameters recorded in it.
+	ReprocessIf []string
+	// Version is the tool version recorded in the signature, dev by
+	// default.
+	Version string
+	// Debug, when set, receives a trace of the search.
+	Debug io.Writer
+}
+
+// Result describes the outcome of a recompression.
+type Result struct {
+	SizeBefore int64
+	SizeAfter  int64
+	BestQ      int
+	Skipped    bool
+	Copied     bool
+	// Scores holds the final scores of the output by metric name, over the
+	// whole image: the chosen metric, psnr, ssim, mse and butteraugli, or
+	// every registered metric with AllScores.
+	Scores map[string]float64
+	Sample int
+	// SourceQuality is the IJG-equivalent quality estimated from the source
+	// quantization tables, 0 when unknown.
+	SourceQuality int
+	// Orientation is the Exif orientation (2 to 8) applied to the pixels
+	// with AutoOrient, 0 if none was.
+	Orientation int
+	// ColorProfile is the description of the source ICC profile, and
+	// ConvertedToSRGB tells whether its pixels were converted to sRGB.
+	ColorProfile    string
+	ConvertedToSRGB bool
+	// ChromaSubsampling is the subsampling of the output (444, 422 or
+	// 420), for colour images and encoders that support it.
+	ChromaSubsampling string
+	// Lossless tells that the output is the lossless optimization of the
+	// source: BestQ and Scores are then not set.
+	Lossless bool
+	// Candidates holds the outcome of the search for each chroma
+	// subsampling of a joint search.
+	Candidates []SearchCandidate
+	// WorstTile is the tile of the output with the worst score for the
+	// chosen metric, with the tiled aggregates.
+	WorstTile *TileScore
+	// Metadata lists, in file order, what the metadata policy did with
+	// each source segment of the output and why. It is empty when the
+	// source is kept.
+	Metadata []MetadataDecision
+	// DroppedSegments names the source metadata segments that are not in
+	// the output (e.g. APP1:ExtendedXMP, COM), in file order.
+	DroppedSegments []string
+	// TrailerSize is the number of bytes found after the primary image.
+	TrailerSize int64
+	// Constraint names what determined BestQ: threshold or min_quality for
+	// the metric search, target_size or max_quality in target size mode.
+	Constraint string
+	// Reprocessed is the ReprocessIf condition met by the signature of a
+	// source processed again.
+	Reprocessed string
+	// Reason explains why the source was kept (Skipped or Copied):
+	// already_processed, too_large, trailer_present,
+	// source_quality_below_min, threshold_not_met (no quality in range
+	// meets the threshold), target_size_not_met (no quality in range fits
+	// the target size, or the one that fits misses the threshold), no_gain
+	// or below_min_gain.
+	Reason   string
+	Duration time.Duration
+	Err      error
+
+	// SourceInfo and OutputInfo are filled by RecompressFile.
+	SourceInfo os.FileInfo
+	OutputInfo os.FileInfo
+}
+
+// Validate reports options that cannot be used. Zero fields are checked
+// as their defaults.
+func (o Options) Validate() error {
+	o = o.withDefaults()
+	if o.Metric != "" {
+		m, err := LookupMetric(o.Metric)
+		if err != nil {
+			return err
+		}
+		// Older versions compared 1-MSE to the threshold: such thresholds
+		// would now let every quality through
+		if m.Name() == "mse" && o.Threshold >= 0.5 {
+			return fmt.Errorf("invalid mse threshold %g: mse is a maximum error now, lower is better (e.g. 0.00005 for the former 0.99995)", o.Threshold)
+		}
+	}
+	if o.ChromaSubsampling != "" && o.ChromaSubsampling != "auto" {
+		if _, err := subsampleRatio(o.ChromaSubsampling); err != nil {
+			return err
+		}
+	}
+	if o.Encoder != "" {
+		if _, err := LookupEncoder(o.Encoder); err != nil {
+			return err
+		}
+	}
+	if o.MetadataPolicy != nil {
+		if err := o.MetadataPolicy.Validate(); err != nil {
+			return err
+		}
+	}
+	switch o.Trailer {
+	case "", "keep", "strip", "skip-file":
+	default:
+		return fmt.Errorf("invalid trailer policy '%s' (use keep, strip or skip-file)", o.Trailer)
+	}
+	if err := validateReprocessIf(o.ReprocessIf); err != nil {
+		return err
+	}
+	switch o.SRGBProfile {
+	case "", "embed", "none":
+	default:
+		return fmt.Errorf("invalid sRGB profile '%s' (use embed or none)", o.SRGBProfile)
+	}
+	if o.MinGainPercent < 0 || o.MinGainPercent >= 100 || o.MinGainBytes < 0 {
+		return fmt.Errorf("invalid minimum gain")
+	}
+	switch o.MetricAggregate {
+	case "", "mean", "min-tile", "p5-tile":
+	default:
+		return fmt.Errorf("invalid metric aggregate '%s' (use mean, min-tile or p5-tile)", o.MetricAggregate)
+	}
+	if o.TileSize != 0 && o.TileSize < 16 {
+		return fmt.Errorf("invalid tile size %d (use 16 or more)", o.TileSize)
+	}
+	if o.Threads < 0 || o.MemoryBudget < 0 {
+		return fmt.Errorf("invalid threads or memory budget")
+	}
+	if o.MinQuality < 0 || o.MaxQuality > 100 || o.MinQuality > o.MaxQuality {
+		return fmt.Errorf("invalid quality range %d-%d", o.MinQuality, o.MaxQuality)
+	}
+	if o.TargetSize < 0 {
+		return fmt.Errorf("invalid target size %d", o.TargetSize)
+	}
+	if o.TargetRatio < 0 || o.TargetRatio > 1 {
+		return fmt.Errorf("invalid target ratio %g (use a value in ]0,1])", o.TargetRatio)
+	}
+	if o.Lossless && (o.Quality > 0 || o.targetMode() || o.AutoOrient || o.ConvertToSRGB) {
+		return fmt.Errorf("lossless mode cannot be combined with a quality, a target size, auto-orient or sRGB conversion")
+	}
+	switch o.Search {
+	case "", "quality":
+	case "joint":
+		if o.Quality > 0 || o.targetMode() || o.Lossless || o.ChromaSubsampling != "" {
+			return fmt.Errorf("joint search cannot be combined with a quality, a target size, lossless mode or a chroma subsampling")
+		}
+	default:
+		return fmt.Errorf("invalid search '%s' (use quality or joint)", o.Search)
+	}
+	return nil
+}
+
+// withDefaults fills the zero fields of o.
+func (o Options) withDefaults() Options {
+	if o.Metric == "" {
+		o.Metric = "psnr"
+	}
+	if o.Encoder == "" {
+		o.Encoder = "std"
+	}
+	if o.Threshold == 0 && !o.targetMode() {
+		o.Threshold = DefaultThreshold(o.Metric)
+	}
+	if o.MinQuality == 0 {
+		o.MinQuality = 70
+	}
+	if o.MaxQuality == 0 {
+		o.MaxQuality = 90
+	}
+	if o.TileSize == 0 {
+		o.TileSize = defaultTileSize
+	}
+	if o.Signature == "" {
+		o.Signature = Signature
+	}
+	if o.Trailer == "" {
+		o.Trailer = "keep"
+	}
+	if o.SRGBProfile == "" {
+		o.SRGBProfile = "embed"
+	}
+	if o.Version == "" {
+		o.Version = "dev"
+	}
+	return o
+}
+
+// metadataPolicy resolves the policy and its shorthands.
+func (o Options) metadataPolicy() *MetadataPolicy {
+	preset := "web"
+	switch {
+	case o.SkipMetadata:
+		preset = "none"
+	case o.KeepAllMetadata:
+		preset = "archive"
+	case o.MetadataPolicy != nil:
+		return o.MetadataPolicy
+	}
+	p := metadataPresets[preset]
+	return &p
+}
+
+func (o Options) targetMode() bool {
+	return o.TargetSize > 0 || o.TargetRatio > 0
+}
+
+// budget returns the target size in bytes for a source of sizeBefore bytes.
+func (o Options) budget(sizeBefore int64) int64 {
+	budget := o.TargetSize
+	if o.TargetRatio > 0 {
+		if b := int64(o.TargetRatio * float64(sizeBefore)); budget == 0 || b < budget {
+			budget = b
+		}
+	}
+	return budget
+}
+
+func subsampleRatio(chroma string) (image.YCbCrSubsampleRatio, error) {
+	switch chroma {
+	case "444":
+		return image.YCbCrSubsampleRatio444, nil
+	case "422":
+		return image.YCbCrSubsampleRatio422, nil
+	case "420":
+		return image.YCbCrSubsampleRatio420, nil
+	}
+	return 0, fmt.Errorf("invalid chroma subsampling '%s' (use 444, 422, 420 or auto)", chroma)
+}
+
+// Recompress reads an image from r and writes the smallest JPEG meeting the
+// options to w, with the source metadata transplanted. When recompression
+// is not worth it, the source bytes are written unchanged and the result is
+// marked Skipped (already processed, or too large to analyse) or Copied (no
+// gain, or less than the minimum gain), with Result.Reason telling which.
+// The returned error is also stored in Result.Err.
+func Recompress(ctx context.Context, r io.Reader, w io.Writer, opts Options) (Result, error) {
+	startTime := time.Now()
+	res := Result{}
+	fail := func(err error) (Result, error) {
+		res.Err = err
+		res.Duration = time.Since(startTime)
+		return res, err
+	}
+	if err := opts.Validate(); err != nil {
+		return fail(err)
+	}
+	opts = opts.withDefaults()
+	metric, _ := LookupMetric(opts.Metric)
+	encoder, _ := LookupEncoder(opts.Encoder)
+	debug := opts.Debug
+	encOpts := EncodeOptions{Progressive: opts.Progressive}
+
+	srcData, err := io.ReadAll(r)
+	if err != nil {
+		return fail(err)
+	}
+	res.SizeBefore = int64(len(srcData))
+
+	keepSource := func() (Result, error) {
+		res.SizeAfter = res.SizeBefore
+		if _, err := w.Write(srcData); err != nil {
+			return fail(err)
+		}
+		res.Duration = time.Since(startTime)
+		return res, nil
+	}
+
+	// The signature of the output records the original file: carried over
+	// from the signature of the source when there is one
+	sig := &SignatureInfo{Tool: opts.Signature, Version: opts.Version, Encoder: encoder.Name(),
+		OriginalSize: res.SizeBefore}
+	if opts.Quality == 0 {
+		sig.Metric, sig.Threshold = metric.Name(), opts.Threshold
+	}
+	prev := readSignature(srcData, append([]string{opts.Signature}, knownSignatures...))
+	if prev != nil && !opts.Force {
+		if res.Reprocessed = opts.reprocessReason(prev); res.Reprocessed == "" {
+			res.Skipped, res.Reason = true, "already_processed"
+			return keepSource()
+		}
+		if debug != nil {
+			fmt.Fprintf(debug, "[DEBUG] Already processed by %s %s, processing again: %s.\n", prev.Tool, prev.Version, res.Reprocessed)
+		}
+	}
+	if prev != nil && !prev.Legacy && prev.OriginalSHA256 != "" {
+		sig.OriginalSize, sig.OriginalSHA256 = prev.OriginalSize, prev.OriginalSHA256
+	} else {
+		sig.OriginalSHA256 = fmt.Sprintf("%x", sha256.Sum256(srcData))
+	}
+
+	srcPrimary, trailer := splitTrailer(srcData)
+	res.TrailerSize = int64(len(trailer))
+	if trailer != nil && opts.Trailer == "skip-file" {
+		res.Skipped, res.Reason = true, "trailer_present"
+		return keepSource()
+	}
+	if trailer != nil && debug != nil {
+		fmt.Fprintf(debug, "[DEBUG] Found %s of trailing data after the primary image (policy: %s).\n", FormatSize(res.TrailerSize), opts.Trailer)
+	}
+
+	// skipLossy is the reason why the lossy search is not run, leaving
+	// the lossless optimization as the only way to gain
+	skipLossy := ""
+	if isJPEG(srcData) {
+		res.SourceQuality = estimateQuality(srcData)
+	}
+	if res.SourceQuality > 0 && opts.Quality == 0 && !opts.IgnoreSourceQuality && !opts.Lossless {
+		// Going above the source quality only adds bytes
+		if res.SourceQuality < opts.MinQuality {
+			if debug != nil {
+				fmt.Fprintf(debug, "[DEBUG] Source quality %d is below the minimum quality %d.\n", res.SourceQuality, opts.MinQuality)
+			}
+			skipLossy = "source_quality_below_min"
+		} else if res.SourceQuality < opts.MaxQuality {
+			if debug != nil {
+				fmt.Fprintf(debug, "[DEBUG] Max quality clamped to the source quality %d.\n", res.SourceQuality)
+			}
+			opts.MaxQuality = res.SourceQuality
+		}
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(srcData))
+	if err != nil {
+		return fail(err)
+	}
+
+	// metaSrc is where the output metadata is taken from
+	metaSrc := srcData
+	if opts.AutoOrient && isJPEG(srcData) {
+		if o, at := findOrientation(srcData); o > 1 {
+			if debug != nil {
+				fmt.Fprintf(debug, "[DEBUG] Applying Exif orientation %d.\n", o)
+			}
+			img = orientImage(img, o)
+			metaSrc = resetOrientation(srcData, at)
+			res.Orientation = o
+		}
+	}
+
+	var icc colorHandling
+	if profile := iccProfile(srcData); profile != nil {
+		info, err := parseICC(profile)
+		switch {
+		case err != nil:
+			res.ColorProfile = "unreadable"
+			icc.protect = "(unreadable)"
+		case info.isSRGB():
+			res.ColorProfile = info.name()
+		case opts.ConvertToSRGB && info.Matrix != nil:
+			if debug != nil {
+				fmt.Fprintf(debug, "[DEBUG] Converting from %s to sRGB.\n", info.name())
+			}
+			res.ColorProfile = info.name()
+			img = convertToSRGB(img, info)
+			icc.converted, res.ConvertedToSRGB = true, true
+			if opts.SRGBProfile == "embed" {
+				icc.profile = iccSegments(srgbProfile())
+			}
+		default:
+			if opts.ConvertToSRGB && debug != nil {
+				fmt.Fprintf(debug, "[DEBUG] %s is not a matrix/TRC RGB profile: not converted.\n", info.name())
+			}
+			res.ColorProfile = info.name()
+			icc.protect = info.name()
+		}
+	}
+
+	actualSample := opts.Sample
+	if actualSample <= 0 {
+		actualSample = getAdaptiveSample(img.Bounds())
+	}
+	// Only the search runs a metric: a fixed quality encodes any size
+	if actualSample == 0 && opts.Quality == 0 && !opts.Lossless && skipLossy == "" {
+		skipLossy = "too_large"
+	}
+	res.Sample = actualSample
+
+	// joint tells whether the search also picks the chroma subsampling
+	joint := false
+	if _, gray := img.(*image.Gray); !gray && encoder.Capabilities().ChromaSubsampling {
+		encOpts.ChromaSubsampling = encoder.Capabilities().DefaultChromaSubsampling
+		joint = opts.Search == "joint"
+		switch opts.ChromaSubsampling {
+		case "":
+		case "auto":
+			if opts.Quality == 0 && !opts.targetMode() {
+				joint = true
+				break
+			}
+			if actualSample > 0 {
+				encOpts.ChromaSubsampling = autoSubsampling(img, actualSample)
+			}
+			if debug != nil {
+				fmt.Fprintf(debug, "[DEBUG] Chroma subsampling %s chosen from the chroma detail.\n", subsamplingName(encOpts.ChromaSubsampling))
+			}
+		default:
+			encOpts.ChromaSubsampling, _ = subsampleRatio(opts.ChromaSubsampling)
+		}
+		res.ChromaSubsampling = subsamplingName(encOpts.ChromaSubsampling)
+	}
+
+	encode := func(buf *bytes.Buffer, q int) error {
+		if err := encoder.Encode(buf, img, q, encOpts); err != nil {
+			return fmt.Errorf("%s encoder at quality %d: %v", encoder.Name(), q, err)
+		}
+		return nil
+	}
+
+	// finalize rebuilds an encoding as it will be written, metadata and
+	// trailer included, with the metadata decisions it took
+	policy := opts.metadataPolicy()
+	trailerPolicy, trailerReason := opts.Trailer, "trailer policy strip"
+	if trailer != nil && trailerPolicy == "keep" && policy.scrubs() {
+		if debug != nil {
+			fmt.Fprintf(debug, "[DEBUG] Stripping the trailer: policy %s scrubs metadata, which the trailer carries unscrubbed.\n", policy.Name)
+		}
+		trailerPolicy, trailerReason = "strip", "policy "+policy.Name+" scrubs metadata (cannot be scrubbed)"
+	}
+	finalize := func(data []byte, q int) ([]byte, []MetadataDecision) {
+		if !isJPEG(srcData) {
+			return data, nil
+		}
+		sig.Quality = q
+		out, decisions := transplantMetadata(metaSrc, data, policy, icc, sig)
+		if trailer == nil {
+			return out, decisions
+		}
+		if trailerPolicy == "strip" {
+			decisions = append(decisions, MetadataDecision{Segment: "trailer", Size: len(trailer), Action: "removed", Reason: trailerReason})
+			out, mpfDropped := dropTrailerRefs(out)
+			if mpfDropped {
+				for i := range decisions {
+					if decisions[i].Segment == "APP2:MPF" && decisions[i].Action == "kept" {
+						decisions[i].Action, decisions[i].Reason = "removed", "trailer stripped"
+					}
+				}
+			}
+			return out, decisions
+		}
+		// Motion Photo offsets (XMP MicroVideoOffset, Container:Item) are
+		// counted from the end of the file, so appending the trailer
+		// unchanged keeps them valid; only MPF offsets need fixing.
+		fixMPF(srcData, out, len(srcPrimary))
+		return append(out, trailer...), decisions
+	}
+
+	// finalSize returns the size of an encoding as it will be written,
+	// without the trailer, which target sizes do not count
+	finalSize := func(data []byte, q int) int64 {
+		out, _ := finalize(data, q)
+		size := int64(len(out))
+		if trailerPolicy == "keep" {
+			size -= res.TrailerSize
+		}
+		return size
+	}
+
+	// gainReason returns why out cannot replace the source, or ""
+	gainReason := func(out []byte) string {
+		if int64(len(out)) >= res.SizeBefore {
+			if debug != nil {
+				fmt.Fprintf(debug, "[DEBUG] No gain (new: %s, old: %s).\n", FormatSize(int64(len(out))), FormatSize(res.SizeBefore))
+			}
+			return "no_gain"
+		}
+		if saved := res.SizeBefore - int64(len(out)); saved < opts.MinGainBytes || float64(saved)*100 < opts.MinGainPercent*float64(res.SizeBefore) {
+			if debug != nil {
+				fmt.Fprintf(debug, "[DEBUG] Gain below minimum (new: %s, old: %s).\n", FormatSize(int64(len(out))), FormatSize(res.SizeBefore))
+			}
+			return "below_min_gain"
+		}
+		return ""
+	}
+
+	var bestData []byte
+	bestQ := opts.Quality
+	switch {
+	case opts.Lossless || skipLossy != "":
+	case opts.Quality > 0:
+		var buf bytes.Buffer
+		if err := encode(&buf, opts.Quality); err != nil {
+			return fail(err)
+		}
+		bestData = buf.Bytes()
+	default:
+		switch {
+		case opts.targetMode():
+			bestQ, bestData, res.Constraint, err = searchTargetSize(ctx, img, encode, finalSize, metric, opts, actualSample, opts.budget(int64(len(srcPrimary))))
+		case joint:
+			var sr searchResult
+			sr, encOpts.ChromaSubsampling, res.Candidates, err = jointSearch(ctx, img, encoder, encOpts, metric, opts, actualSample, res.SizeBefore)
+			bestQ, bestData, res.Constraint = sr.q, sr.data, sr.constraint
+			res.ChromaSubsampling = subsamplingName(encOpts.ChromaSubsampling)
+		default:
+			var sr searchResult
+			sr, err = search(ctx, img, encode, metric, opts, actualSample, res.SizeBefore)
+			bestQ, bestData, res.Constraint = sr.q, sr.data, sr.constraint
+		}
+		if err != nil {
+			return fail(err)
+		}
+
+		// Decode best image to calculate final metrics
+		finalImg, _, _ := image.Decode(bytes.NewReader(bestData))
+		if finalImg != nil {
+			res.Scores = map[string]float64{}
+			names := []string{metric.Name(), "psnr", "ssim", "mse", "butteraugli"}
+			if opts.AllScores {
+				names = MetricNames()
+			}
+			for _, name := range names {
+				if _, done := res.Scores[name]; done {
+					continue
+				}
+				m, _ := LookupMetric(name)
+				res.Scores[name] = m.Compare(img, finalImg, actualSample)
+			}
+			if opts.tiled() {
+				_, res.WorstTile = opts.compare(metric, img, finalImg, actualSample)
+			}
+		}
+	}
+
+	// outData is the output, and decisions its metadata decisions
+	var outData []byte
+	var decisions []MetadataDecision
+	reason := skipLossy
+	switch {
+	case bestData != nil:
+		res.BestQ = bestQ
+		outData, decisions = finalize(bestData, bestQ)
+		reason = gainReason(outData)
+	case reason == "" && opts.targetMode():
+		reason = "target_size_not_met"
+	case reason == "" && !opts.Lossless:
+		reason = "threshold_not_met"
+	}
+
+	// The lossless optimization works on the source coefficients: it is
+	// only possible if the pixels were not transformed
+	if opts.Lossless || (reason != "" && opts.Quality == 0 && !opts.NoLosslessFallback &&
+		res.Orientation == 0 && !res.ConvertedToSRGB) {
+		data, err := optimizeJPEG(srcPrimary, opts.Progressive)
+		switch {
+		case err != nil && opts.Lossless:
+			return fail(err)
+		case err != nil:
+			if debug != nil {
+				fmt.Fprintf(debug, "[DEBUG] No lossless optimization: %v.\n", err)
+			}
+		default:
+			// Quality 0 marks the output as lossless. The fallback keeps
+			// the encoder, metric and threshold of the search, which
+			// -reprocess-if compares on later runs
+			sig.Quality = 0
+			if opts.Lossless {
+				sig.Metric, sig.Threshold = "", 0
+			}
+			out, outDecisions := finalize(data, 0)
+			why := gainReason(out)
+			if why == "" && opts.targetMode() && finalSize(data, 0) > opts.budget(int64(len(srcPrimary))) {
+				if debug != nil {
+					fmt.Fprintf(debug, "[DEBUG] Lossless optimization does not fit the target size either.\n")
+				}
+				why = reason
+			}
+			if why == "" {
+				if debug != nil {
+					fmt.Fprintf(debug, "[DEBUG] Lossless optimization: %s.\n", FormatSize(int64(len(out))))
+				}
+				outData, decisions, reason = out, outDecisions, ""
+				res.Lossless, res.BestQ, res.Scores, res.Constraint = true, 0, nil, ""
+				res.ChromaSubsampling = "" // That of the source
+				res.Candidates, res.WorstTile = nil, nil
+			} else if opts.Lossless {
+				reason = why
+			}
+		}
+	}
+
+	if reason != "" {
+		if reason == skipLossy {
+			res.Skipped = true
+		} else {
+			res.Copied = true
+		}
+		res.Reason = reason
+		return keepSource()
+	}
+
+	res.Metadata = decisions
+	for _, d := range decisions {
+		if d.Action == "removed" {
+			res.DroppedSegments = append(res.DroppedSegments, d.Segment)
+		}
+	}
+
+	if _, err := w.Write(outData); err != nil {
+		return fail(err)
+	}
+	res.SizeAfter = int64(len(outData))
+	res.Duration = time.Since(startTime)
+	return res, nil
+}
+
+// searchTargetSize runs the binary search for the highest quality whose
+// final size fits in budget bytes, then checks the optional metric floor
+// (opts.Threshold) on it. It returns no data when no quality in range fits
+// or when the one that fits misses the floor.
+func searchTargetSize(ctx context.Context, img image.Image, encode func(*bytes.Buffer, int) error, finalSize func([]byte, int) int64, metric Metric, opts Options, actualSample int, budget int64) (int, []byte, string, error) {
+	debug := opts.Debug
+	grid := opts.qualityGrid()
+	var bestData []byte
+	best := -1
+	lo, hi := 0, len(grid)-1
+
+	for lo <= hi {
+		if err := ctx.Err(); err != nil {
+			return 0, nil, "", err
+		}
+		mid := (lo + hi) / 2
+		currentQ := grid[mid]
+
+		var buf bytes.Buffer
+		if err := encode(&buf, currentQ); err != nil {
+			return 0, nil, "", err
+		}
+		size := finalSize(buf.Bytes(), currentQ)
+
+		if debug != nil {
+			fmt.Fprintf(debug, "[DEBUG] currentQ=%d Encode to %s Size=%s (Target=%s)\n",
+				currentQ, opts.Encoder, FormatSize(size), FormatSize(budget))
+		}
+
+		if size <= budget {
+			// Fits: try a higher quality
+			best = mid
+			bestData = buf.Bytes()
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+
+	if bestData == nil {
+		if debug != nil {
+			fmt.Fprintf(debug, "[DEBUG] No quality in [%d,%d] fits the target size of %s.\n", opts.MinQuality, opts.MaxQuality, FormatSize(budget))
+		}
+		return 0, nil, "", nil
+	}
+
+	bestQ := grid[best]
+	if opts.Threshold != 0 {
+		compImg, _, err := image.Decode(bytes.NewReader(bestData))
+		if err != nil {
+			return 0, nil, "", err
+		}
+		sim, worst := opts.compare(metric, img, compImg, actualSample)
+		if debug != nil {
+			fmt.Fprintf(debug, "[DEBUG] Floor check at q=%d Metric=%s Score=%.6g (Threshold=%g)\n",
+				bestQ, strings.ToUpper(metric.Name()), sim, opts.Threshold)
+			debugWorstTile(debug, worst)
+		}
+		if !metric.Direction().Meets(sim, opts.Threshold) {
+			if debug != nil {
+				fmt.Fprintf(debug, "[DEBUG] The target size of %s cannot be met with %s %g.\n",
+					FormatSize(budget), strings.ToUpper(metric.Name()), opts.Threshold)
+			}
+			return 0, nil, "", nil
+		}
+	}
+
+	constraint := "target_size"
+	if best == len(grid)-1 {
+		constraint = "max_quality"
+	}
+	return bestQ, bestData, constraint, nil
+}
+
+func getAdaptiveSample(b image.Rectangle) int {
+	pixels := b.Dx() * b.Dy()
+	if pixels > 128000000 { // Limite à 128MP
+		return 0
+	}
+	// The metrics read the pixels directly, in parallel: every pixel is
+	// scored up to 32MP
+	if pixels <= 32000000 {
+		return 1
+	}
+	return 2
+}
+
+// FormatSize renders a byte count as KB or MB.
+func FormatSize(size int64) string {
+	if size >= 1048576 {
+		return fmt.Sprintf("%.2f MB", float64(size)/1048576)
+	}
+	return fmt.Sprintf("%.1f KB", float64(size)/1024)
+}
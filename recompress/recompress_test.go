@@ -0,0 +1,29 @@
+package recompress
+
+import "testing"
+
+// TestQualityDefaults checks that each quality bound is defaulted on its
+// own before the range is validated.
+func TestQualityDefaults(t *testing.T) {
+	tests := []struct {
+		opts     Options
+		min, max int
+		valid    bool
+	}{
+		{Options{}, 70, 90, true},
+		{Options{MinQuality: 80}, 80, 90, true},
+		{Options{MaxQuality: 75}, 70, 75, true},
+		{Options{MinQuality: 50, MaxQuality: 60}, 50, 60, true},
+		{Options{MaxQuality: 60}, 70, 60, false},
+	}
+	for _, tt := range tests {
+		err := tt.opts.Validate()
+		if (err == nil) != tt.valid {
+			t.Errorf("%d-%d: error %v, want valid %v", tt.opts.MinQuality, tt.opts.MaxQuality, err, tt.valid)
+		}
+		o := tt.opts.withDefaults()
+		if o.MinQuality != tt.min || o.MaxQuality != tt.max {
+			t.Errorf("%d-%d: defaults %d-%d, want %d-%d", tt.opts.MinQuality, tt.opts.MaxQuality, o.MinQuality, o.MaxQuality, tt.min, tt.max)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package recompress
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// searchResult is the outcome of a quality search: the chosen quality, its
+// encoding and score, and the constraint that determined the choice. data
+// is nil when no quality in range meets the threshold.
+type searchResult struct {
+	q          int
+	data       []byte
+	score      float64
+	constraint string
+}
+
+// verifyWindow is the number of qualities below the boundary found by the
+// search strategy that the verification pass evaluates. Encoders such as
+// Jpegli are not monotonic: a quality can fall short of the threshold
+// while the one below it meets it.
+const verifyWindow = 2
+
+// evaluation is the encoding of the image at one quality and its score.
+type evaluation struct {
+	q     int
+	data  []byte
+	score float64
+	// worst is the worst tile with the tiled aggregates
+	worst *TileScore
+	// meets tells whether the score meets the threshold; it is false when
+	// the encoding cannot be decoded
+	meets bool
+}
+
+// evaluator encodes the image at the qualities a search strategy asks
+// for and scores the encodings. Evaluations are memoised: each quality is
+// encoded once, however many times it is asked for. Distinct qualities can
+// be evaluated concurrently.
+type evaluator struct {
+	ctx        context.Context
+	img        image.Image
+	encode     func(*bytes.Buffer, int) error
+	metric     Metric
+	opts       Options
+	sample     int
+	sizeBefore int64
+
+	mu    sync.Mutex // Guards cache and the debug output
+	cache map[int]*evaluation
+}
+
+// eval returns the evaluation of quality q.
+func (e *evaluator) eval(q int) (*evaluation, error) {
+	if ev := e.cached(q); ev != nil {
+		return ev, nil
+	}
+	if err := e.ctx.Err(); err != nil {
+		return nil, err
+	}
+	debug := e.opts.Debug
+
+	startTime := time.Now()
+	var buf bytes.Buffer
+	if err := e.encode(&buf, q); err != nil {
+		return nil, err
+	}
+	duration := time.Since(startTime)
+
+	ev := &evaluation{q: q, data: buf.Bytes()}
+	startTime = time.Now()
+	compImg, _, err := image.Decode(bytes.NewReader(ev.data))
+	durationDecode := time.Since(startTime)
+	if err == nil && compImg != nil {
+		ev.score, ev.worst = e.opts.compare(e.metric, e.img, compImg, e.sample)
+		ev.meets = e.metric.Direction().Meets(ev.score, e.opts.Threshold)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.cache[q] = ev
+	if debug != nil && compImg != nil {
+		currentSize := int64(len(ev.data))
+		gain := 100 - (float64(currentSize) / float64(e.sizeBefore) * 100)
+
+		fmt.Fprintf(debug, "[DEBUG] currentQ=%d Encode to %s duration=%s Metric=%s Score=%.6g (Threshold=%g) Size=%s Gain=%.1f%%\n",
+			q, e.opts.Encoder, duration.Round(time.Millisecond).String(),
+			strings.ToUpper(e.metric.Name()), ev.score, e.opts.Threshold, FormatSize(currentSize), gain)
+		debugWorstTile(debug, ev.worst)
+		if durationDecode > 50*time.Millisecond {
+			// Only log decode if significant
+			fmt.Fprintf(debug, "[DEBUG]   (Decode took %s)\n", durationDecode.Round(time.Millisecond).String())
+		}
+	}
+	return ev, nil
+}
+
+// debugWorstTile traces the worst tile of an evaluation, if any.
+func debugWorstTile(debug io.Writer, worst *TileScore) {
+	if worst != nil {
+		fmt.Fprintf(debug, "[DEBUG]   Worst tile %dx%d at (%d,%d): Score=%.6g\n", worst.Width, worst.Height, worst.X, worst.Y, worst.Score)
+	}
+}
+
+// cached returns the evaluation of quality q if it was done, nil otherwise.
+func (e *evaluator) cached(q int) *evaluation {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.cache[q]
+}
+
+// evalAll evaluates the qualities qs concurrently, one goroutine each.
+func (e *evaluator) evalAll(qs []int) error {
+	errs := make([]error, len(qs))
+	var wg sync.WaitGroup
+	for i, q := range qs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = e.eval(q)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A searchStrategy finds the boundary in grid, a list of increasing
+// qualities: the index of the lowest quality meeting the threshold, or
+// len(grid) if none does, assuming the score is monotonic in quality.
+type searchStrategy interface {
+	boundary(e *evaluator, grid []int) (int, error)
+}
+
+// binarySearch halves the range holding the boundary at each evaluation.
+type binarySearch struct{}
+
+func (binarySearch) boundary(e *evaluator, grid []int) (int, error) {
+	lo, hi := 0, len(grid)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		ev, err := e.eval(grid[mid])
+		if err != nil {
+			return 0, err
+		}
+		if ev.meets {
+			// Meets the threshold: try even lower qualities
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return lo, nil
+}
+
+// parallelSearch is a binary search that evaluates ahead: the qualities it
+// may probe over its next steps, breadth first, are evaluated concurrently,
+// up to threads at a time. It then walks down the evaluated levels, and
+// takes the same path as binarySearch in up to log2(threads+1) times fewer
+// rounds. It finds the same boundary, even when the score is not
+// monotonic.
+type parallelSearch struct {
+	threads int
+}
+
+func (p parallelSearch) boundary(e *evaluator, grid []int) (int, error) {
+	lo, hi := 0, len(grid)
+	for lo < hi {
+		var probes []int
+		for ranges := [][2]int{{lo, hi}}; len(ranges) > 0 && len(probes) < p.threads; ranges = ranges[1:] {
+			l, h := ranges[0][0], ranges[0][1]
+			if l >= h {
+				continue
+			}
+			mid := (l + h) / 2
+			if e.cached(grid[mid]) == nil {
+				probes = append(probes, grid[mid])
+			}
+			ranges = append(ranges, [2]int{l, mid}, [2]int{mid + 1, h})
+		}
+		if err := e.evalAll(probes); err != nil {
+			return 0, err
+		}
+
+		for lo < hi {
+			mid := (lo + hi) / 2
+			ev := e.cached(grid[mid])
+			if ev == nil {
+				break
+			}
+			if ev.meets {
+				hi = mid
+			} else {
+				lo = mid + 1
+			}
+		}
+	}
+	return lo, nil
+}
+
+// evalMemory is a rough estimate of the peak memory of one evaluation of
+// an image of bounds b with metric: encoder buffers, encoded and decoded
+// images, and the working set of the metric.
+func evalMemory(b image.Rectangle, metric Metric) int64 {
+	perPixel := int64(defaultMemoryPerPixel)
+	if m, ok := metric.(MemoryEstimator); ok {
+		perPixel = m.MemoryPerPixel()
+	}
+	return int64(b.Dx()) * int64(b.Dy()) * perPixel
+}
+
+// searchThreads returns the number of qualities evaluated concurrently for
+// an image of bounds b scored with metric: Threads, capped by MemoryBudget.
+func (o Options) searchThreads(b image.Rectangle, metric Metric) int {
+	threads := max(o.Threads, 1)
+	if o.MemoryBudget > 0 {
+		threads = min(threads, max(int(o.MemoryBudget/max(evalMemory(b, metric), 1)), 1))
+	}
+	return threads
+}
+
+// qualityGrid returns the qualities a search can pick, from MinQuality to
+// MaxQuality by steps of 2 in fast mode, 1 otherwise. MaxQuality is always
+// included.
+func (o Options) qualityGrid() []int {
+	step := 1
+	if o.Fast {
+		step = 2
+	}
+	var grid []int
+	for q := o.MinQuality; q < o.MaxQuality; q += step {
+		grid = append(grid, q)
+	}
+	return append(grid, o.MaxQuality)
+}
+
+// search looks for the lowest quality whose encoding still meets the
+// threshold. The boundary found by the search strategy is then verified:
+// the qualities just below it are evaluated too, and the boundary moves
+// down while one of them meets the threshold.
+func search(ctx context.Context, img image.Image, encode func(*bytes.Buffer, int) error, metric Metric, opts Options, actualSample int, sizeBefore int64) (searchResult, error) {
+	e := &evaluator{ctx: ctx, img: img, encode: encode, metric: metric, opts: opts,
+		sample: actualSample, sizeBefore: sizeBefore, cache: map[int]*evaluation{}}
+	grid := opts.qualityGrid()
+	var strategy searchStrategy = binarySearch{}
+	threads := opts.searchThreads(img.Bounds(), metric)
+	if threads > 1 {
+		if opts.Debug != nil {
+			fmt.Fprintf(opts.Debug, "[DEBUG] Evaluating up to %d qualities concurrently.\n", threads)
+		}
+		strategy = parallelSearch{threads: threads}
+	}
+
+	b, err := strategy.boundary(e, grid)
+	if err != nil {
+		return searchResult{}, err
+	}
+	if threads > 1 {
+		// Evaluate the verification window at once
+		var window []int
+		for i := max(b-verifyWindow, 0); i < b; i++ {
+			if e.cached(grid[i]) == nil {
+				window = append(window, grid[i])
+			}
+		}
+		if err := e.evalAll(window); err != nil {
+			return searchResult{}, err
+		}
+	}
+	for i := b - 1; i >= 0 && i >= b-verifyWindow; i-- {
+		ev, err := e.eval(grid[i])
+		if err != nil {
+			return searchResult{}, err
+		}
+		if ev.meets {
+			if opts.Debug != nil {
+				fmt.Fprintf(opts.Debug, "[DEBUG] Quality %d meets the threshold too: the score is not monotonic in quality.\n", grid[i])
+			}
+			b = i
+		}
+	}
+
+	if b == len(grid) {
+		if opts.Debug != nil {
+			fmt.Fprintf(opts.Debug, "[DEBUG] No quality in [%d,%d] meets the threshold.\n", opts.MinQuality, opts.MaxQuality)
+		}
+		return searchResult{}, nil
+	}
+	ev := e.cache[grid[b]]
+	constraint := "threshold"
+	if b == 0 {
+		constraint = "min_quality"
+	}
+	return searchResult{q: ev.q, data: ev.data, score: ev.score, constraint: constraint}, nil
+}
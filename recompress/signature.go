@@ -0,0 +1,157 @@
+package recompress
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SignatureInfo is the payload of the APP15 signature: how the file was
+// produced, and what it was produced from. It is written as the signature
+// of the tool, a NUL byte and JSON.
+type SignatureInfo struct {
+	Tool      string  `json:"tool"`
+	Version   string  `json:"version"`
+	Encoder   string  `json:"encoder"`
+	Metric    string  `json:"metric,omitempty"`
+	Threshold float64 `json:"threshold,omitempty"`
+	Quality   int     `json:"quality"`
+	// OriginalSize and OriginalSHA256 describe the file before its first
+	// processing: they are carried over when a file is processed again.
+	OriginalSize   int64  `json:"original_size"`
+	OriginalSHA256 string `json:"original_sha256"`
+	// Legacy is set for the bare signatures written by older versions,
+	// which carry no payload.
+	Legacy bool `json:"-"`
+}
+
+// knownSignatures are the signatures of the tools writing this format.
+var knownSignatures = []string{Signature, "jpegli-encode.go"}
+
+// ReprocessConditions are the conditions accepted by Options.ReprocessIf.
+var ReprocessConditions = []string{"different-encoder", "different-metric", "older-version", "looser-threshold"}
+
+// parseSignature returns the signature carried by the APP15 segment seg,
+// or nil if seg is not a signature of one of the tools.
+func parseSignature(seg []byte, signatures []string) *SignatureInfo {
+	if seg[1] != 0xEF {
+		return nil
+	}
+	payload := seg[4:]
+	for _, sig := range signatures {
+		if !bytes.HasPrefix(payload, []byte(sig)) {
+			continue
+		}
+		rest := payload[len(sig):]
+		if len(rest) == 0 {
+			return &SignatureInfo{Tool: sig, Legacy: true}
+		}
+		if rest[0] != 0 {
+			continue
+		}
+		info := &SignatureInfo{}
+		if err := json.Unmarshal(rest[1:], info); err != nil {
+			return &SignatureInfo{Tool: sig, Legacy: true}
+		}
+		info.Tool = sig
+		return info
+	}
+	return nil
+}
+
+// readSignature returns the first signature found in the JPEG data, or nil.
+func readSignature(data []byte, signatures []string) *SignatureInfo {
+	var info *SignatureInfo
+	walkSegments(data, func(marker byte, seg []byte) bool {
+		if marker == 0xDA {
+			return false
+		}
+		info = parseSignature(seg, signatures)
+		return info == nil
+	})
+	return info
+}
+
+// segment returns the APP15 segment carrying info.
+func (info *SignatureInfo) segment() []byte {
+	payload, _ := json.Marshal(info)
+	payload = append(append([]byte(info.Tool), 0), payload...)
+	seg := []byte{0xFF, 0xEF, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}
+	return append(seg, payload...)
+}
+
+// olderVersion reports whether version a is older than b. Versions are
+// compared numerically, field by field (v1.10.0 > v1.9.2); "dev" builds
+// are never older nor newer.
+func olderVersion(a, b string) bool {
+	if a == "dev" || b == "dev" {
+		return false
+	}
+	fa := strings.FieldsFunc(strings.TrimPrefix(a, "v"), func(r rune) bool { return r == '.' || r == '-' })
+	fb := strings.FieldsFunc(strings.TrimPrefix(b, "v"), func(r rune) bool { return r == '.' || r == '-' })
+	for i := 0; i < len(fa) && i < len(fb); i++ {
+		na, errA := strconv.Atoi(fa[i])
+		nb, errB := strconv.Atoi(fb[i])
+		if errA != nil || errB != nil {
+			if fa[i] != fb[i] {
+				return fa[i] < fb[i]
+			}
+			continue
+		}
+		if na != nb {
+			return na < nb
+		}
+	}
+	return len(fa) < len(fb)
+}
+
+// reprocessReason returns the first condition of ReprocessIf that prev, the
+// signature of the source, meets, or "" if the source must be kept. A
+// legacy signature meets every condition: nothing is known of it.
+func (o Options) reprocessReason(prev *SignatureInfo) string {
+	for _, cond := range o.ReprocessIf {
+		if prev.Legacy {
+			return cond
+		}
+		switch cond {
+		case "different-encoder":
+			if !strings.EqualFold(prev.Encoder, o.Encoder) {
+				return cond
+			}
+		case "different-metric":
+			if !strings.EqualFold(prev.Metric, o.Metric) {
+				return cond
+			}
+		case "older-version":
+			if olderVersion(prev.Version, o.Version) {
+				return cond
+			}
+		case "looser-threshold":
+			// Thresholds of different metrics cannot be compared
+			metric, err := LookupMetric(o.Metric)
+			if err != nil || !strings.EqualFold(prev.Metric, o.Metric) || o.Threshold == 0 {
+				continue
+			}
+			if prev.Threshold != o.Threshold && !metric.Direction().Meets(prev.Threshold, o.Threshold) {
+				return cond
+			}
+		}
+	}
+	return ""
+}
+
+// validateReprocessIf reports unknown conditions.
+func validateReprocessIf(conds []string) error {
+	for _, c := range conds {
+		known := false
+		for _, k := range ReprocessConditions {
+			known = known || c == k
+		}
+		if !known {
+			return fmt.Errorf("invalid reprocess condition '%s' (use %s)", c, strings.Join(ReprocessConditions, ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package recompress
+
+import (
+	"image"
+	"math"
+)
+
+// SSIM as defined by Wang et al. (2004) and its reference implementation:
+// an 11x11 Gaussian window of standard deviation 1.5, K1=0.01, K2=0.03 for
+// 8-bit samples, averaged over the windows that fit in the image.
+const (
+	ssimC1 = (0.01 * 255) * (0.01 * 255)
+	ssimC2 = (0.03 * 255) * (0.03 * 255)
+)
+
+// ssimWindow is the normalised 11-tap Gaussian of standard deviation 1.5;
+// the 2-D window is its outer product.
+var ssimWindow = func() [11]float64 {
+	var w [11]float64
+	var sum float64
+	for i := range w {
+		d := float64(i - 5)
+		w[i] = math.Exp(-d * d / (2 * 1.5 * 1.5))
+		sum += w[i]
+	}
+	for i := range w {
+		w[i] /= sum
+	}
+	return w
+}()
+
+// msssimWeights are the scale weights of MS-SSIM (Wang et al., 2003), from
+// the full resolution down.
+var msssimWeights = []float64{0.0448, 0.2856, 0.3001, 0.2363, 0.1333}
+
+// plane is a channel of an image as float samples in [0, 255].
+type plane struct {
+	w, h int
+	pix  []float64
+}
+
+// ycbcrPlanes returns the luma of img, and its JFIF chroma when chroma is
+// set, averaged over boxes of sample x sample pixels.
+func ycbcrPlanes(img image.Image, sample int, chroma bool) []plane {
+	b := img.Bounds()
+	w, h := (b.Dx()+sample-1)/sample, (b.Dy()+sample-1)/sample
+	n := 1
+	if chroma {
+		n = 3
+	}
+	planes := make([]plane, n)
+	for i := range planes {
+		planes[i] = plane{w, h, make([]float64, w*h)}
+	}
+	forBands(h, 16, func(_, lo, hi int) {
+		var rgb []uint8
+		for y := lo; y < hi; y++ {
+			y0, y1 := b.Min.Y+y*sample, min(b.Min.Y+(y+1)*sample, b.Max.Y)
+			for sy := y0; sy < y1; sy++ {
+				rgb = rgbRow(rgb, img, sy, b.Min.X, b.Max.X, 1)
+				for x := 0; x < b.Dx(); x++ {
+					r, g, bl := float64(rgb[3*x]), float64(rgb[3*x+1]), float64(rgb[3*x+2])
+					i := y*w + x/sample
+					planes[0].pix[i] += 0.299*r + 0.587*g + 0.114*bl
+					if chroma {
+						planes[1].pix[i] += 128 - 0.168736*r - 0.331264*g + 0.5*bl
+						planes[2].pix[i] += 128 + 0.5*r - 0.418688*g - 0.081312*bl
+					}
+				}
+			}
+			if sample == 1 {
+				continue
+			}
+			for x := 0; x < w; x++ {
+				area := float64((y1 - y0) * (min((x+1)*sample, b.Dx()) - x*sample))
+				for _, p := range planes {
+					p.pix[y*w+x] /= area
+				}
+			}
+		}
+	})
+	return planes
+}
+
+// ssimPlanes returns the planes compared by SSIM. As in ssim.m, images
+// are first reduced by f = max(1, round(min(M, N)/256)): an f x f box
+// filter with symmetric padding, of which one pixel out of f is kept from
+// the first. With a sample at least as coarse as f, the sample boxes of
+// ycbcrPlanes are used instead.
+func ssimPlanes(img image.Image, sample int, chroma bool) []plane {
+	b := img.Bounds()
+	f := max(1, int(math.Round(float64(min(b.Dx(), b.Dy()))/256)))
+	if f <= sample {
+		return ycbcrPlanes(img, sample, chroma)
+	}
+	n := 1
+	if chroma {
+		n = 3
+	}
+	w, h := (b.Dx()+f-1)/f, (b.Dy()+f-1)/f
+	planes := make([]plane, n)
+	for i := range planes {
+		planes[i] = plane{w, h, make([]float64, w*h)}
+	}
+	// imfilter centres an even window after its middle, and mirrors the
+	// image past its edges
+	c0 := (f - 1) / 2
+	mirror := func(i, n int) int {
+		switch {
+		case i < 0:
+			return -i - 1
+		case i >= n:
+			return 2*n - 1 - i
+		}
+		return i
+	}
+	norm := 1 / float64(f*f)
+	forBands(h, 16, func(_, lo, hi int) {
+		var rgb []uint8
+		for y := lo; y < hi; y++ {
+			for k := 0; k < f; k++ {
+				rgb = rgbRow(rgb, img, b.Min.Y+mirror(y*f+k-c0, b.Dy()), b.Min.X, b.Max.X, 1)
+				for x := 0; x < w; x++ {
+					var sum [3]float64
+					for j := 0; j < f; j++ {
+						sx := 3 * mirror(x*f+j-c0, b.Dx())
+						r, g, bl := float64(rgb[sx]), float64(rgb[sx+1]), float64(rgb[sx+2])
+						sum[0] += 0.299*r + 0.587*g + 0.114*bl
+						if chroma {
+							sum[1] += 128 - 0.168736*r - 0.331264*g + 0.5*bl
+							sum[2] += 128 + 0.5*r - 0.418688*g - 0.081312*bl
+						}
+					}
+					for i, p := range planes {
+						p.pix[y*w+x] += sum[i] * norm
+					}
+				}
+			}
+		}
+	})
+	return planes
+}
+
+// downsample halves p with a 2x2 average, the last row and column being
+// mirrored for odd sizes, as the MS-SSIM reference implementation.
+func (p plane) downsample() plane {
+	w, h := (p.w+1)/2, (p.h+1)/2
+	d := plane{w, h, make([]float64, w*h)}
+	for y := 0; y < h; y++ {
+		y0, y1 := 2*y, min(2*y+1, p.h-1)
+		for x := 0; x < w; x++ {
+			x0, x1 := 2*x, min(2*x+1, p.w-1)
+			d.pix[y*w+x] = (p.pix[y0*p.w+x0] + p.pix[y0*p.w+x1] + p.pix[y1*p.w+x0] + p.pix[y1*p.w+x1]) / 4
+		}
+	}
+	return d
+}
+
+// ssimStats returns the mean SSIM and the mean contrast-structure term of
+// p1 against p2 over the Gaussian windows that fit in them. Planes smaller
+// than the window are compared as a single window of uniform weights.
+func ssimStats(p1, p2 plane) (ssim, cs float64) {
+	const k = len(ssimWindow)
+	if p1.w < k || p1.h < k {
+		var m1, m2, s11, s22, s12 float64
+		for i := range p1.pix {
+			m1 += p1.pix[i]
+			m2 += p2.pix[i]
+		}
+		n := float64(len(p1.pix))
+		m1, m2 = m1/n, m2/n
+		for i := range p1.pix {
+			d1, d2 := p1.pix[i]-m1, p2.pix[i]-m2
+			s11 += d1 * d1
+			s22 += d2 * d2
+			s12 += d1 * d2
+		}
+		s11, s22, s12 = s11/n, s22/n, s12/n
+		cs = (2*s12 + ssimC2) / (s11 + s22 + ssimC2)
+		return (2*m1*m2 + ssimC1) / (m1*m1 + m2*m2 + ssimC1) * cs, cs
+	}
+
+	// The window is separable: each band filters the rows it needs
+	// horizontally, then vertically
+	w, h := p1.w-k+1, p1.h-k+1
+	const bandSize = 32
+	bands := (h + bandSize - 1) / bandSize
+	ssims, css := make([]float64, bands), make([]float64, bands)
+	forBands(h, bandSize, func(band, lo, hi int) {
+		rows := hi - lo + k - 1
+		// Horizontally filtered x, y, x², y² and xy, tap by tap along the
+		// rows
+		var hf [5][]float64
+		for i := range hf {
+			hf[i] = make([]float64, rows*w)
+		}
+		var src [5][]float64
+		for i := range src {
+			src[i] = make([]float64, p1.w)
+		}
+		for r := 0; r < rows; r++ {
+			copy(src[0], p1.pix[(lo+r)*p1.w:][:p1.w])
+			copy(src[1], p2.pix[(lo+r)*p2.w:][:p2.w])
+			for x, v1 := range src[0] {
+				v2 := src[1][x]
+				src[2][x], src[3][x], src[4][x] = v1*v1, v2*v2, v1*v2
+			}
+			for c := range hf {
+				filterTaps(hf[c][r*w:][:w], func(i int) []float64 { return src[c][i:][:w] })
+			}
+		}
+
+		// Then vertically, one output row at a time
+		var acc [5][]float64
+		for i := range acc {
+			acc[i] = make([]float64, w)
+		}
+		var sumSSIM, sumCS float64
+		for y := 0; y < hi-lo; y++ {
+			for c := range acc {
+				clear(acc[c])
+				filterTaps(acc[c], func(i int) []float64 { return hf[c][(y+i)*w:][:w] })
+			}
+			for x := 0; x < w; x++ {
+				m1, m2 := acc[0][x], acc[1][x]
+				s11, s22, s12 := acc[2][x]-m1*m1, acc[3][x]-m2*m2, acc[4][x]-m1*m2
+				c := (2*s12 + ssimC2) / (s11 + s22 + ssimC2)
+				sumSSIM += (2*m1*m2 + ssimC1) / (m1*m1 + m2*m2 + ssimC1) * c
+				sumCS += c
+			}
+		}
+		ssims[band], css[band] = sumSSIM, sumCS
+	})
+	for band := range ssims {
+		ssim += ssims[band]
+		cs += css[band]
+	}
+	n := float64(w * h)
+	return ssim / n, cs / n
+}
+
+// filterTaps adds to out the sum of the inputs in(i) weighted by the taps
+// of ssimWindow, the symmetric taps being applied at once.
+func filterTaps(out []float64, in func(i int) []float64) {
+	const k = len(ssimWindow)
+	for i := 0; i < k/2; i++ {
+		a, b, g := in(i), in(k-1-i), ssimWindow[i]
+		a, b = a[:len(out)], b[:len(out)]
+		for x := range out {
+			out[x] += g * (a[x] + b[x])
+		}
+	}
+	c := in(k / 2)[:len(out)]
+	for x := range out {
+		out[x] += ssimWindow[k/2] * c[x]
+	}
+}
+
+// calculateSSIM returns the SSIM of the luma of img2 against img1, on the
+// planes of ssimPlanes: large images are reduced as by ssim.m, and give
+// the same scores.
+func calculateSSIM(img1, img2 image.Image, sample int) float64 {
+	ssim, _ := ssimStats(ssimPlanes(img1, sample, false)[0], ssimPlanes(img2, sample, false)[0])
+	return ssim
+}
+
+// calculateSSIMYCbCr returns the SSIM of the luma and chroma channels of
+// img2 against img1, weighted 0.8 for Y and 0.1 for Cb and Cr, each on
+// the planes of ssimPlanes.
+func calculateSSIMYCbCr(img1, img2 image.Image, sample int) float64 {
+	p1, p2 := ssimPlanes(img1, sample, true), ssimPlanes(img2, sample, true)
+	var score float64
+	for i, weight := range []float64{0.8, 0.1, 0.1} {
+		ssim, _ := ssimStats(p1[i], p2[i])
+		score += weight * ssim
+	}
+	return score
+}
+
+// calculateMSSSIM returns the multi-scale SSIM of the luma of img2
+// against img1: the contrast-structure terms of five scales, halved each
+// time, and the luminance term of the last one, with the weights of
+// msssimWeights. Images too small for five scales use as many as fit the
+// window, with their weights normalised. Negative terms count as 0. As in
+// the reference msssim.m, the full resolution is the first scale: the
+// reduction of ssimPlanes does not apply.
+func calculateMSSSIM(img1, img2 image.Image, sample int) float64 {
+	p1, p2 := ycbcrPlanes(img1, sample, false)[0], ycbcrPlanes(img2, sample, false)[0]
+	scales := 1
+	for w, h := p1.w, p1.h; scales < len(msssimWeights) && min(w, h) >= 2*len(ssimWindow); scales++ {
+		w, h = (w+1)/2, (h+1)/2
+	}
+	weightSum := 1.0
+	if scales < len(msssimWeights) {
+		weightSum = 0
+		for _, weight := range msssimWeights[:scales] {
+			weightSum += weight
+		}
+	}
+
+	score := 1.0
+	for s := 0; s < scales; s++ {
+		ssim, cs := ssimStats(p1, p2)
+		term := cs
+		if s == scales-1 {
+			// The luminance term only counts at the coarsest scale
+			term = ssim
+		}
+		score *= math.Pow(max(term, 0), msssimWeights[s]/weightSum)
+		if s < scales-1 {
+			p1, p2 = p1.downsample(), p2.downsample()
+		}
+	}
+	return score
+}
@@ -0,0 +1,160 @@
+package recompress
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+// ssimFixture is a grey test image: gradients, a texture and a checker
+// board, all in integers so that the reference values below can be
+// reproduced exactly.
+func ssimFixture(w, h int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Pix[y*img.Stride+x] = uint8((x*5+y*3)%200 + (x*y)%37 + (x/8+y/8)%2*16)
+		}
+	}
+	return img
+}
+
+// ssimDistort returns img with uniform noise in [-k, k] from a linear
+// congruential generator seeded with seed.
+func ssimDistort(img *image.Gray, k int, seed uint32) *image.Gray {
+	out := image.NewGray(img.Bounds())
+	s := seed
+	for i, v := range img.Pix {
+		s = (s*1103515245 + 12345) & (1<<31 - 1)
+		out.Pix[i] = uint8(min(max(int(v)+int(s>>16)%(2*k+1)-k, 0), 255))
+	}
+	return out
+}
+
+// ssimImage returns a w x h grey image of the samples f(x, y).
+func ssimImage(w, h int, f func(x, y int) int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Pix[y*img.Stride+x] = uint8(f(x, y))
+		}
+	}
+	return img
+}
+
+// ssimRamp returns the closed form SSIM of the ramps a1*x+b1 and a2*x+b2
+// along x, n samples wide, from the definitions of Wang et al. (2004): a
+// window centred on x has the means a*x+b, the variances a²v and the
+// covariance a1*a2*v, v being the second moment of the 11-tap Gaussian of
+// standard deviation 1.5, and SSIM is their mean over the n-10 positions.
+func ssimRamp(a1, b1, a2, b2 float64, n int) float64 {
+	var sum, v float64
+	for d := -5.0; d <= 5; d++ {
+		g := math.Exp(-d * d / (2 * 1.5 * 1.5))
+		sum += g
+		v += g * d * d
+	}
+	v /= sum
+	c1, c2 := math.Pow(0.01*255, 2), math.Pow(0.03*255, 2)
+	var ssim float64
+	for x := 5; x < n-5; x++ {
+		m1, m2 := a1*float64(x)+b1, a2*float64(x)+b2
+		ssim += (2*m1*m2 + c1) / (m1*m1 + m2*m2 + c1) * (2*a1*a2*v + c2) / ((a1*a1+a2*a2)*v + c2)
+	}
+	return ssim / float64(n-10)
+}
+
+// TestSSIMReference checks the scores against closed forms of the
+// definitions, as computed by Wang's ssim.m and msssim.m on the same
+// pixels:
+//   - constant images, whose windows all have the luminance term of the
+//     two values and no contrast or structure term; MS-SSIM keeps the
+//     luminance of its coarsest scale, with weight 0.1333;
+//   - ramps along x, whose windows are ramps too (ssimRamp);
+//   - 400x420 images, which ssim.m reduces by f = 2 with a 2x2 box: the
+//     ramps are written so that the reduced ones are x+20 and x/2+60;
+//   - MS-SSIM of ramps differing by a constant, whose contrast-structure
+//     terms are 1: after the 2x2 averages the coarsest scale is the ramp
+//     8x+3.5, 16 samples wide, and its luminance terms alone remain.
+func TestSSIMReference(t *testing.T) {
+	lum := func(a, b float64) float64 {
+		c1 := math.Pow(0.01*255, 2)
+		return (2*a*b + c1) / (a*a + b*b + c1)
+	}
+	var msRamp float64
+	for x := 5; x < 11; x++ {
+		m := 8*float64(x) + 3.5
+		msRamp += lum(m, m+100) / 6
+	}
+	tests := []struct {
+		name       string
+		compare    func(image.Image, image.Image, int) float64
+		w, h       int
+		img1, img2 func(x, y int) int
+		want       float64
+	}{
+		{
+			"ssim constant", calculateSSIM, 64, 48,
+			func(x, y int) int { return 100 },
+			func(x, y int) int { return 120 },
+			lum(100, 120),
+		},
+		{
+			"ssim ramps", calculateSSIM, 96, 80,
+			func(x, y int) int { return 2*x + 10 },
+			func(x, y int) int { return x + 60 },
+			ssimRamp(2, 10, 1, 60, 96),
+		},
+		{
+			"ssim downsampled", calculateSSIM, 400, 420,
+			func(x, y int) int { return x/2 + 20 },
+			func(x, y int) int { return x/4 + x%2*(x/2-2*(x/4)) + 60 },
+			ssimRamp(1, 20, 0.5, 60, 200),
+		},
+		{
+			"ms-ssim constant", calculateMSSSIM, 256, 256,
+			func(x, y int) int { return 60 },
+			func(x, y int) int { return 90 },
+			math.Pow(lum(60, 90), 0.1333),
+		},
+		{
+			"ms-ssim ramps", calculateMSSSIM, 256, 256,
+			func(x, y int) int { return x / 2 },
+			func(x, y int) int { return x/2 + 100 },
+			math.Pow(msRamp, 0.1333),
+		},
+	}
+	for _, tt := range tests {
+		got := tt.compare(ssimImage(tt.w, tt.h, tt.img1), ssimImage(tt.w, tt.h, tt.img2), 1)
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: got %.12f, want %.12f", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestSSIMProperties checks that identical images score 1 and that the
+// scores drop as the distortion grows.
+func TestSSIMProperties(t *testing.T) {
+	metrics := []struct {
+		name    string
+		compare func(image.Image, image.Image, int) float64
+	}{
+		{"ssim", calculateSSIM},
+		{"ssim-ycbcr", calculateSSIMYCbCr},
+		{"ms-ssim", calculateMSSSIM},
+	}
+	orig := ssimFixture(200, 180)
+	for _, m := range metrics {
+		if got := m.compare(orig, orig, 1); math.Abs(got-1) > 1e-9 {
+			t.Errorf("%s: identical images score %.9f, want 1", m.name, got)
+		}
+		prev := 1.0
+		for _, k := range []int{2, 8, 32} {
+			got := m.compare(orig, ssimDistort(orig, k, 1), 1)
+			if got >= prev {
+				t.Errorf("%s: noise %d scores %.6f, not below %.6f", m.name, k, got, prev)
+			}
+			prev = got
+		}
+	}
+}
@@ -0,0 +1,438 @@
+package recompress
+
+import (
+	"image"
+	"math"
+	"sync"
+)
+
+// SSIMULACRA2, as implemented by libjxl (tools/ssimulacra2.cc): over six
+// scales, the images are converted from linear sRGB to a positive XYB,
+// blurred with a recursive Gaussian of standard deviation 1.5, and compared
+// with an SSIM variant and two edge difference maps, whose 1-norms and
+// 4-norms are weighted into a score from 100 (identical) down.
+
+const ssimulacra2Scales = 6
+
+// ssimulacra2Weights weigh the 108 features of six scales, walked by
+// channel (X, Y, B), scale, norm (1, 4) and map (SSIM, artifact, detail
+// lost). As in libjxl, images with fewer scales walk them with a running
+// index, so that the weights of a channel start after those of the scales
+// computed for the previous one.
+var ssimulacra2Weights = [108]float64{
+	0.0, 0.0007376606707406586, 0.0,
+	0.0, 0.0007793481682867309, 0.0,
+	0.0, 0.0004371155730107379, 0.0,
+	1.1041726426657346, 0.00066284834129271, 0.00015231632783718752,
+	0.0, 0.0016406437456599754, 0.0,
+	1.8422455520539298, 11.441172603757666, 0.0,
+	0.0007989109436015163, 0.000176816438078653, 0.0,
+	1.8787594979546387, 10.94906990605142, 0.0,
+	0.0007289346991508072, 0.9677937080626833, 0.0,
+	0.00014003424285435884, 0.9981766977854967, 0.00031949755934435053,
+	0.0004550992113792063, 0.0, 0.0,
+	0.0013648766163243398, 0.0, 0.0,
+	0.0, 0.0, 0.0,
+	7.466890328078848, 0.0, 17.445833984131262,
+	0.0006235601634041466, 0.0, 0.0,
+	6.683678146179332, 0.00037724407979611296, 1.027889937768264,
+	225.20515300849274, 0.0, 0.0,
+	19.213238186143016, 0.0011401524586618361, 0.001237755635509985,
+	176.39317598450694, 0.0, 0.0,
+	24.43300999870476, 0.28520802612117757, 0.0004485436923833408,
+	0.0, 0.0, 0.0,
+	34.77906344483772, 44.835625328877896, 0.0,
+	0.0, 0.0, 0.0,
+	0.0, 0.0, 0.0,
+	0.0, 0.0008680556573291698, 0.0,
+	0.0, 0.0, 0.0,
+	0.0005313191874358747, 0.0, 0.00016533814161379112,
+	0.0, 0.0, 0.0,
+	0.0, 0.0, 0.0004179171803251336,
+	0.0017290828234722833, 0.0, 0.0020827005846636437,
+	0.0, 0.0, 8.826982764996862,
+	23.19243343998926, 0.0, 95.1080498811086,
+	0.9863978034400682, 0.9834382792465353, 0.0012286405048278493,
+	171.2667255897307, 0.9807858872435379, 0.0,
+	0.0, 0.0, 0.0005130064588990679,
+	0.0, 0.00010854057858411537, 0.0,
+}
+
+// Opsin absorbance of the XYB colour space of JPEG XL.
+var (
+	opsinMatrix = [3][3]float32{
+		{0.30, 0.622, 0.078},
+		{0.23, 0.692, 0.078},
+		{0.24342268924547819, 0.20476744424496821, 0.55180986650955360},
+	}
+	opsinBias     float32 = 0.0037930732552754493
+	opsinBiasCbrt         = float32(math.Cbrt(float64(opsinBias)))
+)
+
+// linearLUT maps 8-bit sRGB samples to linear light in [0, 1].
+var linearLUT = func() (lut [256]float32) {
+	for i := range lut {
+		lut[i] = float32(srgbToLinear(float64(i) / 255))
+	}
+	return lut
+}()
+
+// recursiveGaussian is the IIR approximation of a Gaussian blur of libjxl
+// (Charalampidis, 2016): a sum of three cosines truncated at radius, whose
+// sliding sums only need the samples entering and leaving the window.
+// Samples outside the image count as 0.
+type recursiveGaussian struct {
+	radius int
+	n2, d1 [3]float32
+}
+
+func newRecursiveGaussian(sigma float64) *recursiveGaussian {
+	radius := math.Round(3.2795*sigma + 0.2546)
+	var omega, p, r, rho [3]float64
+	for i := range omega {
+		omega[i] = float64(2*i+1) * math.Pi / (2 * radius)
+		p[i] = 1 / math.Tan(0.5*omega[i])
+		r[i] = p[i] * p[i] / math.Sin(omega[i])
+		rho[i] = math.Exp(-0.5*sigma*sigma*omega[i]*omega[i]) / radius
+	}
+	p[1], r[1] = -p[1], -r[1]
+	d13 := p[0]*r[1] - r[0]*p[1]
+	d35 := p[1]*r[2] - r[1]*p[2]
+	d51 := p[2]*r[0] - r[2]*p[0]
+	zeta15, zeta35 := d35/d13, d51/d13
+
+	// Solve A·beta = gamma for the weights of the cosines
+	a := [3][3]float64{{p[0], p[1], p[2]}, {r[0], r[1], r[2]}, {zeta15, zeta35, 1}}
+	gamma := [3]float64{1, radius*radius - sigma*sigma, zeta15*rho[0] + zeta35*rho[1] + rho[2]}
+	beta := solve3(a, gamma)
+
+	g := &recursiveGaussian{radius: int(radius)}
+	for i := range omega {
+		g.n2[i] = float32(-beta[i] * math.Cos(omega[i]*(radius+1)))
+		g.d1[i] = float32(-2 * math.Cos(omega[i]))
+	}
+	return g
+}
+
+// solve3 solves the 3x3 linear system a·x = b by Cramer's rule.
+func solve3(a [3][3]float64, b [3]float64) [3]float64 {
+	det := func(m [3][3]float64) float64 {
+		return m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+			m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+			m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	}
+	d := det(a)
+	var x [3]float64
+	for j := range x {
+		m := a
+		for i := range m {
+			m[i][j] = b[i]
+		}
+		x[j] = det(m) / d
+	}
+	return x
+}
+
+// blurRow writes to out the blur of in, of the same length.
+func (g *recursiveGaussian) blurRow(in, out []float32) {
+	n := len(in)
+	var prev, prev2 [3]float32
+	for i := -g.radius + 1; i < n; i++ {
+		var sum float32
+		if left := i - g.radius - 1; left >= 0 {
+			sum = in[left]
+		}
+		if right := i + g.radius - 1; right < n {
+			sum += in[right]
+		}
+		var o float32
+		for k := range prev {
+			v := sum*g.n2[k] - prev2[k] - g.d1[k]*prev[k]
+			prev2[k], prev[k] = prev[k], v
+			o += v
+		}
+		if i >= 0 {
+			out[i] = o
+		}
+	}
+}
+
+// s2Image is one scale of an image: the full resolution rows are read
+// from img, those of the lower scales from linear RGB planes.
+type s2Image struct {
+	img  image.Image
+	w, h int
+	pix  [3][]float32
+}
+
+// row fills rgb with the linear RGB of row y. buf is a scratch buffer,
+// returned for reuse.
+func (s *s2Image) row(y int, rgb *[3][]float32, buf []uint8) []uint8 {
+	if s.img == nil {
+		for c := range rgb {
+			rgb[c] = s.pix[c][y*s.w:][:s.w]
+		}
+		return buf
+	}
+	b := s.img.Bounds()
+	buf = rgbRow(buf, s.img, b.Min.Y+y, b.Min.X, b.Max.X, 1)
+	for c := range rgb {
+		if len(rgb[c]) != s.w {
+			rgb[c] = make([]float32, s.w)
+		}
+		for x := range rgb[c] {
+			rgb[c][x] = linearLUT[buf[3*x+c]]
+		}
+	}
+	return buf
+}
+
+// downsample halves s with 2x2 averages, the last row and column being
+// repeated for odd sizes.
+func (s *s2Image) downsample() *s2Image {
+	d := &s2Image{w: (s.w + 1) / 2, h: (s.h + 1) / 2}
+	for c := range d.pix {
+		d.pix[c] = make([]float32, d.w*d.h)
+	}
+	forBands(d.h, 16, func(_, lo, hi int) {
+		var r0, r1 [3][]float32
+		var buf []uint8
+		for y := lo; y < hi; y++ {
+			buf = s.row(2*y, &r0, buf)
+			buf = s.row(min(2*y+1, s.h-1), &r1, buf)
+			for c := range d.pix {
+				out := d.pix[c][y*d.w:][:d.w]
+				for x := range out {
+					x0, x1 := 2*x, min(2*x+1, s.w-1)
+					out[x] = (r0[c][x0] + r0[c][x1] + r1[c][x0] + r1[c][x1]) * 0.25
+				}
+			}
+		}
+	})
+	return d
+}
+
+// xybRow converts a row of linear RGB to channel c of the positive XYB of
+// SSIMULACRA2, into out.
+func xybRow(rgb [3][]float32, c int, out []float32) {
+	mix := func(i, x int) float32 {
+		m := opsinMatrix[i][0]*rgb[0][x] + opsinMatrix[i][1]*rgb[1][x] + opsinMatrix[i][2]*rgb[2][x] + opsinBias
+		return cbrtAdd(max(m, 0), -opsinBiasCbrt)
+	}
+	for x := range out {
+		m0, m1 := mix(0, x), mix(1, x)
+		switch c {
+		case 0:
+			out[x] = 0.5*(m0-m1)*14 + 0.42
+		case 1:
+			out[x] = 0.5*(m0+m1) + 0.01
+		default:
+			out[x] = mix(2, x) - 0.5*(m0+m1) + 0.55
+		}
+	}
+}
+
+// cbrtAdd returns the cube root of x >= 0 plus add, as libjxl computes it:
+// Newton iterations on x^(-1/3) from a guess on the exponent of x.
+func cbrtAdd(x, add float32) float32 {
+	var r float32
+	if bits := math.Float32bits(x); bits != 0 {
+		r = math.Float32frombits(0x54800000 - (bits>>23)*0x002AAAAA)
+	}
+	x3 := x / 3
+	for i := 0; i < 3; i++ {
+		r2 := r * r
+		r = 4.0/3*r - x3*(r2*r2)
+	}
+	r2 := r * r
+	r += (r - x*(r2*r2)) / 3
+	return r*r*x + add
+}
+
+// ssimulacra2Channel compares channel c of one scale of two images, and
+// returns the 1-norm and 4-norm of its SSIM error map, then of its
+// artifact map, then of its detail lost map.
+func ssimulacra2Channel(a, b *s2Image, c int, g *recursiveGaussian) [6]float64 {
+	w, h, n := a.w, a.h, g.radius
+	// The horizontal blurs of the rows of x1, x2, x1², x2² and x1·x2 are
+	// kept over the window of the vertical blur, the last 2n+1 rows,
+	// along with the rows of x1 and x2
+	const x1, x2, quantities = 0, 1, 5
+	window := 2*n + 1
+	var raw [2][][]float32
+	var blurred [quantities][][]float32
+	for q := range blurred {
+		blurred[q] = make([][]float32, window)
+		for i := range blurred[q] {
+			blurred[q][i] = make([]float32, w)
+		}
+	}
+	for i := range raw {
+		raw[i] = make([][]float32, window)
+		for j := range raw[i] {
+			raw[i][j] = make([]float32, w)
+		}
+	}
+	product := make([]float32, w)
+	var rgb [2][3][]float32
+	var buf []uint8
+	addRow := func(y int) {
+		slot := y % window
+		for i, img := range []*s2Image{a, b} {
+			buf = img.row(y, &rgb[i], buf)
+			xybRow(rgb[i], c, raw[i][slot])
+		}
+		r1, r2 := raw[x1][slot], raw[x2][slot]
+		g.blurRow(r1, blurred[0][slot])
+		g.blurRow(r2, blurred[1][slot])
+		for x := range product {
+			product[x] = r1[x] * r1[x]
+		}
+		g.blurRow(product, blurred[2][slot])
+		for x := range product {
+			product[x] = r2[x] * r2[x]
+		}
+		g.blurRow(product, blurred[3][slot])
+		for x := range product {
+			product[x] = r1[x] * r2[x]
+		}
+		g.blurRow(product, blurred[4][slot])
+	}
+
+	// Vertical blur, row by row, all columns at once
+	var prev, prev2 [quantities][3][]float32
+	var out [quantities][]float32
+	sum := make([]float32, w)
+	for q := range prev {
+		for k := range prev[q] {
+			prev[q][k], prev2[q][k] = make([]float32, w), make([]float32, w)
+		}
+		out[q] = make([]float32, w)
+	}
+	var sums [6]float64
+	for y := -n + 1; y < h; y++ {
+		left, right := y-n-1, y+n-1
+		if right < h {
+			addRow(right)
+		}
+		for q := range out {
+			switch {
+			case left >= 0 && right < h:
+				l, r := blurred[q][left%window], blurred[q][right%window]
+				for x := range sum {
+					sum[x] = l[x] + r[x]
+				}
+			case left >= 0:
+				copy(sum, blurred[q][left%window])
+			case right < h:
+				copy(sum, blurred[q][right%window])
+			default:
+				clear(sum)
+			}
+			o := out[q]
+			clear(o)
+			for k := range prev[q] {
+				n2, d1 := g.n2[k], g.d1[k]
+				p, p2 := prev[q][k][:len(o)], prev2[q][k][:len(o)]
+				for x, v := range sum[:len(o)] {
+					v = v*n2 - p2[x] - d1*p[x]
+					p2[x], p[x] = p[x], v
+					o[x] += v
+				}
+			}
+		}
+		if y < 0 {
+			continue
+		}
+
+		r1, r2 := raw[x1][y%window], raw[x2][y%window]
+		for x := 0; x < w; x++ {
+			mu1, mu2 := out[0][x], out[1][x]
+			s11, s22, s12 := out[2][x]-mu1*mu1, out[3][x]-mu2*mu2, out[4][x]-mu1*mu2
+			// SSIM without the denominator of its luminance term, which
+			// would weigh the errors in the darks more
+			const c2 = 0.0009
+			numM := 1 - (mu1-mu2)*(mu1-mu2)
+			d := max(1-float64(numM*(2*s12+c2))/float64(s11+s22+c2), 0)
+			sums[0] += d
+			sums[1] += d * d * d * d
+
+			// Positive when the distorted image has an edge where the
+			// original is smooth (ringing, banding, blocking), negative
+			// when it smoothed an edge of the original (blur)
+			d1 := float64(1+abs32(r2[x]-mu2))/float64(1+abs32(r1[x]-mu1)) - 1
+			artifact, lost := max(d1, 0), max(-d1, 0)
+			sums[2] += artifact
+			sums[3] += artifact * artifact * artifact * artifact
+			sums[4] += lost
+			sums[5] += lost * lost * lost * lost
+		}
+	}
+
+	pixels := float64(w * h)
+	var norms [6]float64
+	for i := 0; i < 6; i += 2 {
+		norms[i] = sums[i] / pixels
+		norms[i+1] = math.Sqrt(math.Sqrt(sums[i+1] / pixels))
+	}
+	return norms
+}
+
+func abs32(v float32) float32 {
+	return math.Float32frombits(math.Float32bits(v) &^ (1 << 31))
+}
+
+// calculateSSIMULACRA2 returns the SSIMULACRA2 score of img2 against img1,
+// 100 for identical images.
+func calculateSSIMULACRA2(img1, img2 image.Image) float64 {
+	g := newRecursiveGaussian(1.5)
+	b := img1.Bounds()
+	a, d := &s2Image{img: img1, w: b.Dx(), h: b.Dy()}, &s2Image{img: img2, w: b.Dx(), h: b.Dy()}
+
+	var scales [][3][6]float64
+	for scale := 0; scale < ssimulacra2Scales; scale++ {
+		if a.w < 8 || a.h < 8 {
+			break
+		}
+		if scale > 0 {
+			a, d = a.downsample(), d.downsample()
+		}
+		var norms [3][6]float64
+		var wg sync.WaitGroup
+		for c := range norms {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				norms[c] = ssimulacra2Channel(a, d, c, g)
+			}()
+		}
+		wg.Wait()
+		scales = append(scales, norms)
+	}
+	return ssimulacra2Score(scales)
+}
+
+// ssimulacra2Score weighs the norms of the computed scales, by scale and
+// channel: SSIM, artifact and detail lost 1-norms then 4-norms, and maps
+// their sum to the score.
+func ssimulacra2Score(scales [][3][6]float64) float64 {
+	var score float64
+	i := 0
+	for c := 0; c < 3; c++ {
+		for _, norms := range scales {
+			for norm := 0; norm < 2; norm++ {
+				for m := 0; m < 3; m++ {
+					score += ssimulacra2Weights[i] * math.Abs(norms[c][2*m+norm])
+					i++
+				}
+			}
+		}
+	}
+
+	score *= 0.9562382616834844
+	score = 2.326765642916932*score - 0.020884521182843837*score*score + 6.248496625763138e-05*score*score*score
+	if score <= 0 {
+		return 100
+	}
+	return 100 - 10*math.Pow(score, 0.6276336467831387)
+}
@@ -0,0 +1,123 @@
+package recompress
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// TestSSIMULACRA2WeightWalk checks that images with fewer than six scales
+// pick their weights as libjxl does: with a running index over the scales
+// computed, so that feature (c, scale, norm, map) of k scales uses the
+// weight at c*6k + scale*6 + norm*3 + map, which is that of another feature
+// of the six scale layout.
+func TestSSIMULACRA2WeightWalk(t *testing.T) {
+	for k := 1; k < ssimulacra2Scales; k++ {
+		for c := 0; c < 3; c++ {
+			for s := 0; s < k; s++ {
+				for i := 0; i < 6; i++ {
+					norm, m := i/3, i%3
+					w := c*6*k + s*6 + i
+					if ssimulacra2Weights[w] == 0 {
+						continue
+					}
+					few := make([][3][6]float64, k)
+					few[s][c][2*m+norm] = 1
+					all := make([][3][6]float64, ssimulacra2Scales)
+					all[w%36/6][w/36][2*(w%3)+w%6/3] = 1
+					if got, want := ssimulacra2Score(few), ssimulacra2Score(all); got != want || got == 100 {
+						t.Errorf("%d scales, channel %d, scale %d, feature %d: score %g, want %g (weight %d)", k, c, s, i, got, want, w)
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestSSIMULACRA2Small checks images too small for six scales: identical
+// images score 100, and a distorted one less.
+func TestSSIMULACRA2Small(t *testing.T) {
+	orig := image.NewRGBA(image.Rect(0, 0, 40, 24))
+	comp := image.NewRGBA(orig.Bounds())
+	for y := 0; y < 24; y++ {
+		for x := 0; x < 40; x++ {
+			c := color.RGBA{uint8(x * 6), uint8(y * 10), uint8((x + y) * 4), 255}
+			orig.SetRGBA(x, y, c)
+			if (x/4+y/4)%2 == 0 {
+				c.G += 12
+			}
+			comp.SetRGBA(x, y, c)
+		}
+	}
+	if got := calculateSSIMULACRA2(orig, orig); got != 100 {
+		t.Errorf("identical images score %g, want 100", got)
+	}
+	if got := calculateSSIMULACRA2(orig, comp); got >= 100 {
+		t.Errorf("distorted image scores %g, want less than 100", got)
+	}
+}
+
+// TestSSIMULACRA2XYB checks the positive XYB of SSIMULACRA2 against the
+// definitions of libjxl, computed in float64: sRGB decoded to linear
+// light, mixed by the opsin absorbance matrix with its bias, cube roots
+// minus that of the bias, then X = 14(l-m)/2 + 0.42, Y = (l+m)/2 + 0.01
+// and B = s - Y + 0.55.
+func TestSSIMULACRA2XYB(t *testing.T) {
+	linear := func(v uint8) float64 {
+		c := float64(v) / 255
+		if c <= 0.04045 {
+			return c / 12.92
+		}
+		return math.Pow((c+0.055)/1.055, 2.4)
+	}
+	const bias = 0.0037930732552754493
+	matrix := [3][3]float64{
+		{0.30, 0.622, 0.078},
+		{0.23, 0.692, 0.078},
+		{0.24342268924547819, 0.20476744424496821, 0.55180986650955360},
+	}
+	for _, c := range []color.RGBA{{0, 0, 0, 255}, {255, 255, 255, 255}, {255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}, {12, 130, 201, 255}, {250, 240, 7, 255}} {
+		rgb := [3]float64{linear(c.R), linear(c.G), linear(c.B)}
+		var lms [3]float64
+		for i := range lms {
+			lms[i] = math.Cbrt(matrix[i][0]*rgb[0]+matrix[i][1]*rgb[1]+matrix[i][2]*rgb[2]+bias) - math.Cbrt(bias)
+		}
+		y := (lms[0] + lms[1]) / 2
+		want := [3]float64{14*(lms[0]-lms[1])/2 + 0.42, y + 0.01, lms[2] - y + 0.55}
+
+		row := [3][]float32{{linearLUT[c.R]}, {linearLUT[c.G]}, {linearLUT[c.B]}}
+		for ch := range want {
+			got := make([]float32, 1)
+			xybRow(row, ch, got)
+			if math.Abs(float64(got[0])-want[ch]) > 1e-5 {
+				t.Errorf("%v, channel %d: got %.7f, want %.7f", c, ch, got[0], want[ch])
+			}
+		}
+	}
+}
+
+// TestSSIMULACRA2Blur checks the recursive Gaussian against the Gaussian
+// of standard deviation 1.5 it approximates: the blur of an impulse far
+// from the edges has unit sum, is centred on it with variance 2.25, and
+// is close to the sampled Gaussian at each tap.
+func TestSSIMULACRA2Blur(t *testing.T) {
+	const n, at, sigma = 64, 32, 1.5
+	in, out := make([]float32, n), make([]float32, n)
+	in[at] = 1
+	newRecursiveGaussian(sigma).blurRow(in, out)
+	var sum, mean, variance float64
+	for i, v := range out {
+		d := float64(i - at)
+		sum += float64(v)
+		mean += d * float64(v)
+		variance += d * d * float64(v)
+		want := math.Exp(-d*d/(2*sigma*sigma)) / (sigma * math.Sqrt(2*math.Pi))
+		if math.Abs(float64(v)-want) > 0.003 {
+			t.Errorf("tap %d: got %.5f, want %.5f", i-at, v, want)
+		}
+	}
+	if math.Abs(sum-1) > 1e-3 || math.Abs(mean) > 1e-3 || math.Abs(variance-sigma*sigma) > 0.01 {
+		t.Errorf("sum %.5f, mean %.5f, variance %.5f; want 1, 0, %g", sum, mean, variance, sigma*sigma)
+	}
+}
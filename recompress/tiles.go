@@ -0,0 +1,87 @@
+package recompress
+
+import (
+	"image"
+	"image/draw"
+	"sort"
+)
+
+// TileScore is the score of one tile of the image. X and Y are the offset
+// of the tile from the top-left corner of the image, in pixels.
+type TileScore struct {
+	X      int     `json:"x"`
+	Y      int     `json:"y"`
+	Width  int     `json:"width"`
+	Height int     `json:"height"`
+	Score  float64 `json:"score"`
+}
+
+// defaultTileSize is the tile size of the tiled aggregates when
+// Options.TileSize is zero.
+const defaultTileSize = 256
+
+// tiled tells whether the metric is aggregated over tiles.
+func (o Options) tiled() bool {
+	return o.MetricAggregate == "min-tile" || o.MetricAggregate == "p5-tile"
+}
+
+// compare returns the score of comp against orig as aggregated by
+// MetricAggregate: the score of the whole image for mean, otherwise that
+// of the worst tile (min-tile) or of the 5th percentile of the tiles
+// (p5-tile), with the worst tile.
+func (o Options) compare(metric Metric, orig, comp image.Image, sample int) (float64, *TileScore) {
+	if !o.tiled() {
+		return metric.Compare(orig, comp, sample), nil
+	}
+	b := orig.Bounds()
+	tiles := tileGrid(b, o.TileSize)
+	scores := make([]TileScore, len(tiles))
+	for i, t := range tiles {
+		scores[i] = TileScore{X: t.Min.X - b.Min.X, Y: t.Min.Y - b.Min.Y, Width: t.Dx(), Height: t.Dy(),
+			Score: metric.Compare(subImage(orig, t), subImage(comp, t), sample)}
+	}
+
+	// Worst first, in raster order on equal scores
+	dir := metric.Direction()
+	sort.SliceStable(scores, func(i, j int) bool {
+		if dir == LowerIsBetter {
+			return scores[i].Score > scores[j].Score
+		}
+		return scores[i].Score < scores[j].Score
+	})
+	worst := scores[0]
+	if o.MetricAggregate == "p5-tile" {
+		// The worst 5% of the tiles are let through
+		return scores[len(scores)*5/100].Score, &worst
+	}
+	return worst.Score, &worst
+}
+
+// tileGrid splits b into a grid of tiles of about size pixels a side: as
+// many columns and rows as the rounded ratio of the image size to size,
+// at least one, of sizes equal to within a pixel.
+func tileGrid(b image.Rectangle, size int) []image.Rectangle {
+	cols, rows := max((b.Dx()+size/2)/size, 1), max((b.Dy()+size/2)/size, 1)
+	tiles := make([]image.Rectangle, 0, cols*rows)
+	for r := 0; r < rows; r++ {
+		y0, y1 := b.Min.Y+r*b.Dy()/rows, b.Min.Y+(r+1)*b.Dy()/rows
+		for c := 0; c < cols; c++ {
+			x0, x1 := b.Min.X+c*b.Dx()/cols, b.Min.X+(c+1)*b.Dx()/cols
+			tiles = append(tiles, image.Rect(x0, y0, x1, y1))
+		}
+	}
+	return tiles
+}
+
+// subImage returns the part r of img, at the same coordinates. Images
+// without a SubImage method are copied.
+func subImage(img image.Image, r image.Rectangle) image.Image {
+	if s, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return s.SubImage(r)
+	}
+	dst := image.NewRGBA(r)
+	draw.Draw(dst, r, img, r.Min, draw.Src)
+	return dst
+}
@@ -0,0 +1,159 @@
+package recompress
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// primaryEnd returns the offset just past the EOI marker of the primary
+// image in data, or -1 if it cannot be found. Everything after it is a
+// trailer: Motion Photo videos, MPF secondary images, gain maps...
+func primaryEnd(data []byte) int {
+	return walkSegments(data, func(byte, []byte) bool { return true })
+}
+
+// splitTrailer returns the primary image of data and the bytes that follow
+// its EOI (nil if none).
+func splitTrailer(data []byte) (primary, trailer []byte) {
+	end := primaryEnd(data)
+	if end < 0 || end >= len(data) {
+		return data, nil
+	}
+	return data[:end], data[end:]
+}
+
+// mpfHeader is the APP2 identifier of the CIPA Multi-Picture Format.
+var mpfHeader = []byte("MPF\x00")
+
+// findMPF returns the offset in data of the TIFF header of the MPF APP2
+// segment of the primary image, or -1.
+func findMPF(data []byte) int {
+	for i := 0; i < len(data)-1; {
+		if data[i] != 0xFF {
+			i++
+			continue
+		}
+		marker := data[i+1]
+		if marker == 0x00 || marker == 0xFF {
+			i++
+			continue
+		}
+		if marker == 0xD8 {
+			i += 2
+			continue
+		}
+		if marker == 0xDA {
+			break
+		}
+		if i+3 >= len(data) {
+			break
+		}
+		length := int(data[i+2])<<8 | int(data[i+3])
+		if marker == 0xE2 && i+2+length <= len(data) && bytes.HasPrefix(data[i+4:], mpfHeader) {
+			return i + 4 + len(mpfHeader)
+		}
+		i += 2 + length
+	}
+	return -1
+}
+
+// mpEntries locates the MP Entry array of the MP Index IFD whose TIFF
+// header starts at tiff. It returns the byte order and the offset of the
+// first 16-byte entry and the entry count, or ok=false.
+func mpEntries(data []byte, tiff int) (order binary.ByteOrder, offset, count int, ok bool) {
+	if tiff < 0 || tiff+8 > len(data) {
+		return nil, 0, 0, false
+	}
+	switch string(data[tiff : tiff+4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, 0, 0, false
+	}
+	ifd := tiff + int(order.Uint32(data[tiff+4:]))
+	if ifd+2 > len(data) {
+		return nil, 0, 0, false
+	}
+	n := int(order.Uint16(data[ifd:]))
+	for e := 0; e < n; e++ {
+		entry := ifd + 2 + 12*e
+		if entry+12 > len(data) {
+			return nil, 0, 0, false
+		}
+		if order.Uint16(data[entry:]) != 0xB002 { // MPEntry
+			continue
+		}
+		size := int(order.Uint32(data[entry+4:]))
+		offset = tiff + int(order.Uint32(data[entry+8:]))
+		if size%16 != 0 || offset+size > len(data) {
+			return nil, 0, 0, false
+		}
+		return order, offset, size / 16, true
+	}
+	return nil, 0, 0, false
+}
+
+// fixMPF rewrites, in the new primary image out, the MP entries copied
+// from src so that they describe out followed by the unchanged trailer of
+// src: the primary entry gets the new size, and the secondary images the
+// offsets at which they now live.
+func fixMPF(src, out []byte, srcPrimaryLen int) {
+	srcTiff, outTiff := findMPF(src), findMPF(out)
+	srcOrder, srcEntries, count, ok := mpEntries(src, srcTiff)
+	if !ok {
+		return
+	}
+	outOrder, outEntries, outCount, ok := mpEntries(out, outTiff)
+	if !ok || outCount != count || outOrder != srcOrder {
+		return
+	}
+	for e := 0; e < count; e++ {
+		s, o := srcEntries+16*e, outEntries+16*e
+		offset := int(srcOrder.Uint32(src[s+8:]))
+		if offset == 0 { // The primary image
+			outOrder.PutUint32(out[o+4:], uint32(len(out)))
+			continue
+		}
+		inTrailer := srcTiff + offset - srcPrimaryLen
+		if inTrailer < 0 {
+			continue
+		}
+		outOrder.PutUint32(out[o+8:], uint32(len(out)+inTrailer-outTiff))
+	}
+}
+
+// dropTrailerRefs removes from out, a primary image whose trailer is
+// gone, what pointed into that trailer: the MPF segment is dropped and the
+// Motion Photo flags of the XMP are turned off. The flag replacements keep
+// the XMP segment lengths unchanged. It reports whether an MPF segment was
+// dropped.
+func dropTrailerRefs(out []byte) ([]byte, bool) {
+	mpfDropped := false
+	var rebuilt bytes.Buffer
+	rebuilt.Write(out[:2]) // SOI
+	i := 2
+	for i+4 <= len(out) && out[i] == 0xFF && out[i+1] != 0xDA {
+		length := int(out[i+2])<<8 | int(out[i+3])
+		if i+2+length > len(out) {
+			break
+		}
+		seg := out[i : i+2+length]
+		i += 2 + length
+		if seg[1] == 0xE2 && bytes.HasPrefix(seg[4:], mpfHeader) {
+			mpfDropped = true
+			continue
+		}
+		if seg[1] == 0xE1 {
+			seg = append([]byte(nil), seg...)
+			for _, tag := range []string{"GCamera:MicroVideo", "GCamera:MotionPhoto", "Camera:MotionPhoto"} {
+				seg = bytes.ReplaceAll(seg, []byte(tag+`="1"`), []byte(tag+`="0"`))
+				seg = bytes.ReplaceAll(seg, []byte("<"+tag+">1<"), []byte("<"+tag+">0<"))
+			}
+		}
+		rebuilt.Write(seg)
+	}
+	rebuilt.Write(out[i:])
+	return rebuilt.Bytes(), mpfDropped
+}
@@ -0,0 +1,106 @@
+package recompress
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+)
+
+// testMPF returns primary with a big-endian MPF APP2 segment after its
+// SOI, followed by secondary: the MP entries give the size of both images
+// and the offset of the secondary one from the MPF TIFF header.
+func testMPF(primary, secondary []byte) []byte {
+	o := binary.BigEndian
+	const entries = 2
+	// TIFF header, IFD of 3 entries, next IFD, MP entries
+	ifdSize := 2 + 3*12 + 4
+	tiff := o.AppendUint32([]byte("MM\x00\x2A"), 8)
+	tiff = o.AppendUint16(tiff, 3)
+	tiff = append(o.AppendUint32(o.AppendUint16(o.AppendUint16(tiff, 0xB000), 7), 4), "0100"...)
+	tiff = o.AppendUint32(o.AppendUint32(o.AppendUint16(o.AppendUint16(tiff, 0xB001), 4), 1), entries)
+	tiff = o.AppendUint32(o.AppendUint32(o.AppendUint16(o.AppendUint16(tiff, 0xB002), 7), 16*entries), uint32(8+ifdSize))
+	tiff = o.AppendUint32(tiff, 0)
+
+	payload := append(append([]byte(nil), mpfHeader...), tiff...)
+	segLen := 4 + len(payload) + 16*entries
+	primaryLen := len(primary) + segLen
+	tiffAt := 2 + 4 + len(mpfHeader)
+	entry := func(b []byte, attr, size, offset uint32) []byte {
+		return append(o.AppendUint32(o.AppendUint32(o.AppendUint32(b, attr), size), offset), 0, 0, 0, 0)
+	}
+	payload = entry(payload, 0x20030000, uint32(primaryLen), 0)
+	payload = entry(payload, 0x00020002, uint32(len(secondary)), uint32(primaryLen-tiffAt))
+	seg := append([]byte{0xFF, 0xE2, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}, payload...)
+	return append(withSegment(primary, seg), secondary...)
+}
+
+// TestFixMPF checks that once the primary image is re-encoded, to a new
+// size, the MP entries of the output give its new size and the offset at
+// which the unchanged secondary image now starts.
+func TestFixMPF(t *testing.T) {
+	secondary := testJPEG(t, 32, 24, 90)
+	src := testMPF(testJPEG(t, 128, 96, 98), secondary)
+	srcPrimary, _ := splitTrailer(src)
+	if order, entries, _, ok := mpEntries(src, findMPF(src)); !ok || findMPF(src)+int(order.Uint32(src[entries+16+8:])) != len(srcPrimary) {
+		t.Fatal("the source MP entries do not point at its secondary image")
+	}
+	var out bytes.Buffer
+	res, err := Recompress(context.Background(), bytes.NewReader(src), &out, Options{Quality: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Skipped || res.Copied {
+		t.Fatalf("source kept (%s)", res.Reason)
+	}
+	primary, trailer := splitTrailer(out.Bytes())
+	if len(primary) == len(srcPrimary) {
+		t.Fatal("the primary image kept its size")
+	}
+	if !bytes.Equal(trailer, secondary) {
+		t.Fatal("secondary image not kept")
+	}
+	tiff := findMPF(primary)
+	order, entries, count, ok := mpEntries(primary, tiff)
+	if !ok || count != 2 {
+		t.Fatalf("MP entries not found (%d)", count)
+	}
+	if size := int(order.Uint32(primary[entries+4:])); size != len(primary) {
+		t.Errorf("primary image size %d, want %d", size, len(primary))
+	}
+	if size := int(order.Uint32(primary[entries+16+4:])); size != len(secondary) {
+		t.Errorf("secondary image size %d, want %d", size, len(secondary))
+	}
+	if at := tiff + int(order.Uint32(primary[entries+16+8:])); at != len(primary) {
+		t.Errorf("secondary image offset points at %d, want %d", at, len(primary))
+	}
+}
+
+// TestDropTrailerRefs checks that dropping the references to a trailer
+// removes the MPF segment, turns off the Motion Photo flags of the XMP
+// without changing its length, and keeps everything else.
+func TestDropTrailerRefs(t *testing.T) {
+	xmpPayload := append([]byte(xmpPrefix), `<x:xmpmeta><rdf:Description GCamera:MotionPhoto="1" GCamera:MotionPhotoVersion="1"><Camera:MotionPhoto>1</Camera:MotionPhoto></rdf:Description></x:xmpmeta>`...)
+	xmp := append([]byte{0xFF, 0xE1, byte((len(xmpPayload) + 2) >> 8), byte(len(xmpPayload) + 2)}, xmpPayload...)
+	plain := withSegment(testJPEG(t, 64, 48, 80), xmp)
+	withMPF, _ := splitTrailer(testMPF(plain, testJPEG(t, 16, 12, 80)))
+
+	out, dropped := dropTrailerRefs(withMPF)
+	if !dropped {
+		t.Error("MPF segment not reported dropped")
+	}
+	if findMPF(out) >= 0 {
+		t.Error("MPF segment kept")
+	}
+	want := bytes.Replace(plain, []byte(`GCamera:MotionPhoto="1"`), []byte(`GCamera:MotionPhoto="0"`), 1)
+	want = bytes.Replace(want, []byte(`<Camera:MotionPhoto>1<`), []byte(`<Camera:MotionPhoto>0<`), 1)
+	if !bytes.Equal(out, want) {
+		t.Error("output is not the source with the MPF segment dropped and the Motion Photo flags off")
+	}
+	if !bytes.Contains(out, []byte(`GCamera:MotionPhotoVersion="1"`)) {
+		t.Error("Motion Photo version changed")
+	}
+	if _, dropped := dropTrailerRefs(plain); dropped {
+		t.Error("MPF segment reported dropped from an image without one")
+	}
+}
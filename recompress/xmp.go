@@ -0,0 +1,69 @@
+package recompress
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+const xmpPrefix = "http://ns.adobe.com/xap/1.0/\x00"
+
+// privateXMPProperties are the XMP properties removed by scrubXMP, as
+// regular expressions on their qualified names: GPS coordinates, where the
+// photo was taken or shows, who is in it, and device or owner identifiers.
+var privateXMPProperties = []string{
+	`exif:GPS\w*`,
+	`photoshop:(?:City|State|Country)`,
+	`Iptc4xmpCore:(?:Location|CountryCode|CreatorContactInfo)`,
+	`Iptc4xmpExt:(?:LocationCreated|LocationShown|PersonInImage\w*)`,
+	`mwg-rs:Regions`,
+	`MP:RegionInfo`,
+	`MPRI:Regions`,
+	`aux:(?:SerialNumber|LensSerialNumber|OwnerName)`,
+	`exifEX:(?:BodySerialNumber|LensSerialNumber|CameraOwnerName)`,
+	`Camera:(?:SerialNumber|OwnerName)`,
+}
+
+var (
+	xmpAttrRe = regexp.MustCompile(`\s(` + strings.Join(privateXMPProperties, "|") + `)\s*=\s*(?:"[^"]*"|'[^']*')`)
+	xmpElemRe = regexp.MustCompile(`<(` + strings.Join(privateXMPProperties, "|") + `)[\s/>]`)
+)
+
+// scrubXMP removes the private properties of the XMP APP1 segment seg,
+// written either as attributes or as elements, and returns the rewritten
+// segment with the names of the removed properties.
+func scrubXMP(seg []byte) ([]byte, []string, error) {
+	xmp := string(seg[4+len(xmpPrefix):])
+	var removed []string
+	xmp = xmpAttrRe.ReplaceAllStringFunc(xmp, func(attr string) string {
+		removed = append(removed, xmpAttrRe.FindStringSubmatch(attr)[1])
+		return ""
+	})
+	for {
+		m := xmpElemRe.FindStringSubmatchIndex(xmp)
+		if m == nil {
+			break
+		}
+		name := xmp[m[2]:m[3]]
+		end := strings.IndexByte(xmp[m[0]:], '>')
+		if end < 0 {
+			return nil, nil, errors.New("xmp: unterminated element " + name)
+		}
+		end += m[0] + 1
+		if xmp[end-2] != '/' {
+			closing := strings.Index(xmp[end:], "</"+name+">")
+			if closing < 0 {
+				return nil, nil, errors.New("xmp: unclosed element " + name)
+			}
+			end += closing + len("</"+name+">")
+		}
+		xmp = xmp[:m[0]] + xmp[end:]
+		removed = append(removed, name)
+	}
+	if len(removed) == 0 {
+		return seg, nil, nil
+	}
+	payload := xmpPrefix + xmp
+	out := []byte{0xFF, 0xE1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}
+	return append(out, payload...), removed, nil
+}